@@ -0,0 +1,130 @@
+package tmspevm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	blockPrefix     = []byte("block-")     // blockPrefix + hash -> block
+	blockHashPrefix = []byte("blockhash-") // blockHashPrefix + height -> hash
+)
+
+// Block is the record written for every committed Tendermint block
+type Block struct {
+	Height      uint64
+	Hash        common.Hash //Tendermint block hash
+	Time        uint64
+	ParentHash  common.Hash
+	StateRoot   common.Hash
+	TxHashes    []common.Hash
+	GasUsed     *big.Int
+	Bloom       ethTypes.Bloom
+	TxHash      common.Hash //root of the transactions trie
+	ReceiptHash common.Hash //root of the receipts trie
+	Validators  []ValidatorUpdate
+}
+
+// ValidatorUpdate is a voting power returned by EndBlock, kept with the block
+// so that a replayed block returns it again
+type ValidatorUpdate struct {
+	PubKey []byte //type byte || key
+	Power  uint64
+}
+
+// TxLookupEntry tells where a committed transaction was included
+type TxLookupEntry struct {
+	BlockHash   common.Hash
+	BlockHeight uint64
+	Index       uint64
+}
+
+func blockKey(hash common.Hash) []byte {
+	return append(blockPrefix, hash.Bytes()...)
+}
+
+func blockHashKey(height uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, height)
+	return append(blockHashPrefix, enc...)
+}
+
+func txLookupKey(hash common.Hash) []byte {
+	return append(hash.Bytes(), txMetaSuffix...)
+}
+
+// schedule the block and its height index in the batch
+func putBlock(batch ethdb.Batch, block *Block) error {
+	data, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		return err
+	}
+	if err := batch.Put(blockKey(block.Hash), data); err != nil {
+		return err
+	}
+	return batch.Put(blockHashKey(block.Height), block.Hash.Bytes())
+}
+
+// schedule the lookup entry of a transaction in the batch
+func putTxLookupEntry(batch ethdb.Batch, hash common.Hash, entry TxLookupEntry) error {
+	data, err := rlp.EncodeToBytes(entry)
+	if err != nil {
+		return err
+	}
+	return batch.Put(txLookupKey(hash), data)
+}
+
+// GetTxLookupEntry returns the block and position of a committed transaction
+func (s *State) GetTxLookupEntry(hash common.Hash) (*TxLookupEntry, error) {
+	data, err := s.db.Get(txLookupKey(hash))
+	if err != nil {
+		s.log.Error("GetTxLookupEntry", "error", err)
+		return nil, fmt.Errorf("get-tx-lookup-entry: %v", err)
+	}
+	var entry TxLookupEntry
+	if err := rlp.DecodeBytes(data, &entry); err != nil {
+		s.log.Error("GetTxLookupEntry", "error", err)
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// GetBlockHash returns the hash of the block committed at the given height
+func (s *State) GetBlockHash(height uint64) (common.Hash, error) {
+	data, err := s.db.Get(blockHashKey(height))
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("get-block-hash: %v", err)
+	}
+	return common.BytesToHash(data), nil
+}
+
+// GetBlockByHash returns the block with the given Tendermint hash
+func (s *State) GetBlockByHash(hash common.Hash) (*Block, error) {
+	data, err := s.db.Get(blockKey(hash))
+	if err != nil {
+		s.log.Error("GetBlockByHash", "error", err)
+		return nil, fmt.Errorf("get-block: %v", err)
+	}
+	var block Block
+	if err := rlp.DecodeBytes(data, &block); err != nil {
+		s.log.Error("GetBlockByHash", "error", err)
+		return nil, err
+	}
+	return &block, nil
+}
+
+// GetBlock returns the block committed at the given height
+func (s *State) GetBlock(height uint64) (*Block, error) {
+	hash, err := s.GetBlockHash(height)
+	if err != nil {
+		s.log.Error("GetBlock", "error", err)
+		return nil, err
+	}
+	return s.GetBlockByHash(hash)
+}
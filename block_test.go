@@ -0,0 +1,69 @@
+package tmspevm
+
+import (
+	"math/big"
+	"testing"
+
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestGenesisBlock(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	s := newTestState(t, newTestDB(t), fund(from))
+	genesisRoot := s.lastCommit.Root
+
+	appendBlock(t, s, 1, transfer(t, s, key, 0, to, 1000))
+
+	block, err := s.GetBlock(0)
+	if err != nil {
+		t.Fatalf("genesis block not written: %v", err)
+	}
+	if block.StateRoot != genesisRoot {
+		t.Errorf("genesis root %x, want %x", block.StateRoot, genesisRoot)
+	}
+	if block.TxHash != ethTypes.EmptyRootHash || len(block.TxHashes) != 0 {
+		t.Errorf("genesis block has transactions")
+	}
+
+	child, err := s.GetBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.ParentHash != block.Hash {
+		t.Errorf("parent hash %x, want %x", child.ParentHash, block.Hash)
+	}
+
+	// logs can be searched from genesis
+	if _, err := s.FilterLogs(LogFilter{FromBlock: 0, ToBlock: 1}); err != nil {
+		t.Errorf("FilterLogs from genesis: %v", err)
+	}
+}
+
+func TestStateAt(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	s := newTestState(t, newTestDB(t), fund(from))
+	appendBlock(t, s, 1, transfer(t, s, key, 0, to, 1000))
+	appendBlock(t, s, 2, transfer(t, s, key, 1, to, 1000))
+
+	for blockNr, want := range map[rpc.BlockNumber]int64{
+		0:                     0,
+		1:                     1000,
+		2:                     2000,
+		rpc.LatestBlockNumber: 2000,
+	} {
+		statedb, err := s.StateAt(blockNr)
+		if err != nil {
+			t.Errorf("StateAt(%d): %v", blockNr, err)
+			continue
+		}
+		if balance := statedb.GetBalance(to); balance.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("balance after block %d is %v, want %d", blockNr, balance, want)
+		}
+	}
+	if _, err := s.StateAt(3); err == nil {
+		t.Errorf("StateAt of a future block succeeded")
+	}
+}
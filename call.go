@@ -0,0 +1,147 @@
+package tmspevm
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// callGasCap bounds the gas of calls and estimates, which anyone can make.
+// They run without the lock of the state, but each one still takes a CPU.
+var callGasCap = big.NewInt(50000000)
+
+// Call executes a message against a copy of the state after the given block,
+// pending included, and returns its output and the gas it used. Nothing is
+// persisted. The gas defaults to callGasCap.
+func (s *State) Call(args CallArgs, blockNr rpc.BlockNumber) ([]byte, *big.Int, error) {
+	statedb, context, chainConfig, err := s.callEnv(blockNr)
+	if err != nil {
+		return nil, nil, err
+	}
+	output, gas, _, err := applyCall(statedb, context, chainConfig, args)
+	return output, gas, err
+}
+
+// callEnv copies, under the lock, the state and the block context of a call,
+// so that the EVM runs without holding it. The context of a committed block
+// comes from its record.
+func (s *State) callEnv(blockNr rpc.BlockNumber) (*state.StateDB, vm.Context, params.ChainConfig, error) {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
+	statedb, err := s.stateAt(blockNr)
+	if err != nil {
+		return nil, vm.Context{}, params.ChainConfig{}, err
+	}
+	context := s.blockContext()
+	if blockNr != rpc.PendingBlockNumber {
+		height := s.lastCommit.Height
+		if blockNr != rpc.LatestBlockNumber {
+			height = uint64(blockNr)
+		}
+		block, err := s.GetBlock(height)
+		if err != nil {
+			return nil, vm.Context{}, params.ChainConfig{}, err
+		}
+		context.BlockNumber = new(big.Int).SetUint64(block.Height)
+		context.Time = new(big.Int).SetUint64(block.Time)
+	}
+	return statedb, context, s.chainConfig, nil
+}
+
+// EstimateGas returns the lowest gas limit with which the message succeeds
+// against the pending state. It is bounded by callGasCap, the block gas limit
+// and what the sender can pay at the given gas price.
+func (s *State) EstimateGas(args CallArgs) (*big.Int, error) {
+	statedb, context, chainConfig, err := s.callEnv(rpc.PendingBlockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	lo := params.TxGas.Uint64() - 1
+	hi := callGasCap.Uint64()
+	if context.GasLimit.Cmp(callGasCap) < 0 {
+		hi = context.GasLimit.Uint64()
+	}
+	if args.Gas != nil && args.Gas.BigInt().Cmp(params.TxGas) >= 0 && args.Gas.BigInt().Uint64() < hi {
+		hi = args.Gas.BigInt().Uint64()
+	}
+	if args.GasPrice != nil && args.GasPrice.BigInt().Sign() > 0 {
+		available := statedb.GetBalance(args.From)
+		if args.Value != nil {
+			available = new(big.Int).Sub(available, args.Value.BigInt())
+		}
+		allowance := new(big.Int).Div(available, args.GasPrice.BigInt())
+		if allowance.Sign() < 0 {
+			allowance.SetUint64(0)
+		}
+		if allowance.Cmp(new(big.Int).SetUint64(hi)) < 0 {
+			hi = allowance.Uint64()
+		}
+	}
+	limit := hi
+
+	executable := func(gas uint64) bool {
+		args.Gas = rpc.NewHexNumber(gas)
+		_, _, failed, err := applyCall(statedb.Copy(), context, chainConfig, args)
+		return err == nil && !failed
+	}
+	for lo+1 < hi {
+		mid := (hi + lo) / 2
+		if executable(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	if !executable(hi) {
+		return nil, fmt.Errorf("gas required exceeds allowance (%d) or always failing transaction", limit)
+	}
+	return new(big.Int).SetUint64(hi), nil
+}
+
+// applyCall runs the message in the block context on the given state, which
+// is modified, and tells whether its execution failed. The gas is capped at
+// callGasCap.
+func applyCall(statedb *state.StateDB, context vm.Context, chainConfig params.ChainConfig, args CallArgs) ([]byte, *big.Int, bool, error) {
+	gas := new(big.Int).Set(callGasCap)
+	if args.Gas != nil && args.Gas.BigInt().Cmp(callGasCap) < 0 {
+		gas = args.Gas.BigInt()
+	}
+	gasPrice := new(big.Int)
+	if args.GasPrice != nil {
+		gasPrice = args.GasPrice.BigInt()
+	}
+	value := new(big.Int)
+	if args.Value != nil {
+		value = args.Value.BigInt()
+	}
+
+	// The nonce isn't checked, a call is not a transaction
+	msg := ethTypes.NewMessage(args.From, args.To, statedb.GetNonce(args.From),
+		value, gas, gasPrice, common.FromHex(args.Data), false)
+
+	context.Origin = msg.From()
+	context.GasPrice = msg.GasPrice()
+	recorder := newRevertRecorder(statedb)
+	vmenv := vm.NewEnvironment(context, recorder, &chainConfig, vm.Config{})
+	gp := new(core.GasPool).AddGas(gas)
+	ret, used, err := core.ApplyMessage(vmenv, msg, gp)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	// staking calls fail like the transactions would
+	if !recorder.reverted && isStakingTx(msg.To()) {
+		if _, err := updateBonds(recorder, msg); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	return ret, used, recorder.reverted, nil
+}
@@ -0,0 +1,96 @@
+package tmspevm
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// creationCode stores 1 in slot 0 and deploys the code 0x00
+const creationCode = "0x6001600055600060005360016000f3"
+
+func TestEstimateGas(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	thrower := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	alloc := fund(from)
+	deploy(alloc, thrower, "600056") //PUSH1 0 JUMP, an invalid jump
+	s := newTestState(t, newTestDB(t), alloc)
+
+	gas, err := s.EstimateGas(CallArgs{From: from, To: &to, Value: rpc.NewHexNumber(1000)})
+	if err != nil || gas.Cmp(params.TxGas) != 0 {
+		t.Errorf("transfer estimate %v (%v), want %v", gas, err, params.TxGas)
+	}
+
+	// a contract creation needs exactly the estimate
+	gas, err = s.EstimateGas(CallArgs{From: from, Data: creationCode})
+	if err != nil {
+		t.Fatalf("creation estimate: %v", err)
+	}
+	enough := signTx(t, s, key, ethTypes.NewContractCreation(0, new(big.Int), gas, new(big.Int), common.FromHex(creationCode)))
+	short := signTx(t, s, key, ethTypes.NewContractCreation(1, new(big.Int), new(big.Int).Sub(gas, common.Big1), new(big.Int), common.FromHex(creationCode)))
+	appendBlock(t, s, 1, enough, short)
+	if status, err := s.GetReceiptStatus(enough.Hash()); err != nil || status != ReceiptStatusSuccessful {
+		t.Errorf("creation with the estimate %v: status %d (%v)", gas, status, err)
+	}
+	if status, err := s.GetReceiptStatus(short.Hash()); err != nil || status != ReceiptStatusFailed {
+		t.Errorf("creation below the estimate %v: status %d (%v)", gas, status, err)
+	}
+
+	_, err = s.EstimateGas(CallArgs{From: from, To: &thrower})
+	if err == nil || !strings.Contains(err.Error(), "always failing transaction") {
+		t.Errorf("estimate of a throwing call: %v", err)
+	}
+}
+
+func TestCallGasCap(t *testing.T) {
+	_, from := newTestKey(t)
+	looper := common.HexToAddress("0x00000000000000000000000000000000000000cc")
+	alloc := fund(from)
+	deploy(alloc, looper, "5b600056") //JUMPDEST PUSH1 0 JUMP, an endless loop
+	s := newTestState(t, newTestDB(t), alloc)
+
+	args := CallArgs{From: from, To: &looper, Gas: rpc.NewHexNumber(s.was.gasLimit)}
+	_, used, err := s.Call(args, rpc.LatestBlockNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used.Cmp(callGasCap) != 0 {
+		t.Errorf("gas used %v, want the cap %v", used, callGasCap)
+	}
+}
+
+func TestCallBlockContext(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	clock := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+	alloc := fund(from)
+	// returns NUMBER and TIMESTAMP
+	deploy(alloc, clock, "434260205260005260406000f3")
+	s := newTestState(t, newTestDB(t), alloc)
+	appendBlock(t, s, 1, transfer(t, s, key, 0, to, 1000))
+	appendBlock(t, s, 2, transfer(t, s, key, 1, to, 1000))
+	beginBlock(s, 3)
+
+	for blockNr, want := range map[rpc.BlockNumber][2]int64{
+		1:                      {1, 1001},
+		rpc.LatestBlockNumber:  {2, 1002},
+		rpc.PendingBlockNumber: {3, 1003},
+	} {
+		output, _, err := s.Call(CallArgs{From: from, To: &clock}, blockNr)
+		if err != nil || len(output) != 64 {
+			t.Errorf("Call at %d: %x (%v)", blockNr, output, err)
+			continue
+		}
+		number := new(big.Int).SetBytes(output[:32])
+		time := new(big.Int).SetBytes(output[32:])
+		if number.Int64() != want[0] || time.Int64() != want[1] {
+			t.Errorf("Call at %d sees block %v at %v, want %d at %d", blockNr, number, time, want[0], want[1])
+		}
+	}
+}
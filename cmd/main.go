@@ -53,11 +53,38 @@ var (
         Usage: "TMSP app listen address",
         Value: "tcp://0.0.0.0:46658",
     }
+	TransportFlag = cli.StringFlag{
+		Name:  "transport",
+		Usage: "TMSP transport (socket or grpc)",
+		Value: "socket",
+	}
+	ExternalNodeFlag = cli.BoolFlag{
+		Name:  "external_node",
+		Usage: "Only serve the app and the API, Tendermint runs in a separate process",
+	}
+	TmGenesisFlag = cli.StringFlag{
+		Name:  "tm_genesis",
+		Usage: "Tendermint genesis file, a copy of the external node's one (default: tendermint/genesis.json in the datadir)",
+	}
+	RpcAddressFlag = cli.StringFlag{
+		Name:  "rpc_laddr",
+		Usage: "Tendermint RPC address",
+		Value: "tcp://0.0.0.0:46657",
+	}
 	APIAddrFlag = cli.StringFlag{
 		Name: "apiaddr",
 		Usage: "IP:Port to bind API on",
 		Value: ":8080",
 	}
+	DbBackendFlag = cli.StringFlag{
+		Name: "db_backend",
+		Usage: "Ethereum state database backend (leveldb or memdb)",
+		Value: "leveldb",
+	}
+	ChainIDFlag = cli.Uint64Flag{
+		Name: "chain_id",
+		Usage: "Ethereum chain id (overrides the genesis file)",
+	}
 ) 
 
 func main() {
@@ -77,7 +104,13 @@ func makeApp() *cli.App {
         SyncFlag,
         UpnpFlag,
         TmspAddressFlag, 
-        APIAddrFlag }
+        TransportFlag,
+        ExternalNodeFlag,
+        TmGenesisFlag,
+        RpcAddressFlag,
+        APIAddrFlag,
+        DbBackendFlag,
+        ChainIDFlag }
     app.Action = run
 	
 	app.After = func(ctx *cli.Context) error {
@@ -96,6 +129,9 @@ func run(ctx *cli.Context) error {
 	config := tevm.Config{
 		EthDir: ethDir,
 		ApiAddr: ctx.GlobalString(APIAddrFlag.Name),
+		DbBackend: ctx.GlobalString(DbBackendFlag.Name),
+		ChainID: ctx.GlobalUint64(ChainIDFlag.Name),
+		ExternalNode: ctx.GlobalBool(ExternalNodeFlag.Name),
         TmConfig: getTendermintConfig(ctx),
 	}
 
@@ -115,7 +151,12 @@ func getTendermintConfig(ctx *cli.Context) cfg.Config {
 	config.Set("fast_sync", ctx.GlobalBool(SyncFlag.Name))
 	config.Set("skip_upnp", ctx.GlobalBool(UpnpFlag.Name))
 	config.Set("proxy_app", ctx.GlobalString(TmspAddressFlag.Name))
+	config.Set("tmsp", ctx.GlobalString(TransportFlag.Name))
+	config.Set("rpc_laddr", ctx.GlobalString(RpcAddressFlag.Name))
 	config.Set("log_level", ctx.GlobalString(LogLevelFlag.Name))
+	if genesisFile := ctx.GlobalString(TmGenesisFlag.Name); genesisFile != "" {
+		config.Set("genesis_file", genesisFile)
+	}
 	tmlog.SetLogLevel(config.GetString("log_level"))
 	return config
 }
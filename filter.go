@@ -0,0 +1,194 @@
+package tmspevm
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var mipmapPrefix = []byte("mipmap-log-bloom-")
+
+// LogFilter selects the logs emitted between two blocks (inclusive) by any of
+// the Addresses. Topics are matched by position, an empty position matching
+// any topic.
+type LogFilter struct {
+	FromBlock uint64
+	ToBlock   uint64
+	Addresses []common.Address
+	Topics    [][]common.Hash
+}
+
+// the bloom of level covering block num is stored under the first block of
+// the range
+func mipmapKey(num, level uint64) []byte {
+	lkey := make([]byte, 8)
+	binary.BigEndian.PutUint64(lkey, level)
+	key := new(big.Int).SetUint64(num / level * level)
+	return append(mipmapPrefix, append(lkey, key.Bytes()...)...)
+}
+
+func getMipmapBloom(db ethdb.Database, num, level uint64) ethTypes.Bloom {
+	data, _ := db.Get(mipmapKey(num, level))
+	return ethTypes.BytesToBloom(data)
+}
+
+// adds the addresses and topics of the block logs to the bloom of every
+// MIPMap level covering the block
+func (was *WriteAheadState) writeMipmapBlooms(batch ethdb.Batch) error {
+	if len(was.allLogs) == 0 {
+		return nil
+	}
+	logsBloom := ethTypes.BytesToBloom(ethTypes.LogsBloom(was.allLogs).Bytes())
+	for _, level := range MIPMapLevels {
+		bloom := getMipmapBloom(was.db, was.height, level)
+		for i := range bloom {
+			bloom[i] |= logsBloom[i]
+		}
+		if err := batch.Put(mipmapKey(was.height, level), bloom.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilterLogs returns the committed logs matching the filter. The MIPMap
+// blooms rule out whole ranges of blocks before any receipt is read.
+func (s *State) FilterLogs(filter LogFilter) (vm.Logs, error) {
+	if latest := s.LastBlockHeight(); filter.ToBlock > latest {
+		filter.ToBlock = latest
+	}
+	if filter.FromBlock > filter.ToBlock {
+		return vm.Logs{}, nil
+	}
+	return s.mipFind(filter, filter.FromBlock, filter.ToBlock, 0)
+}
+
+func (s *State) mipFind(filter LogFilter, start, end uint64, depth int) (vm.Logs, error) {
+	logs := vm.Logs{}
+	level := MIPMapLevels[depth]
+	// normalise numerator so we can work in level specific batches and
+	// work with the proper range checks
+	for num := start / level * level; num <= end; num += level {
+		if !filter.bloomMatch(getMipmapBloom(s.db, num, level)) {
+			continue
+		}
+		from, to := num, num+level-1
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		// the lowest level points at single blocks
+		if depth+1 == len(MIPMapLevels) {
+			for height := from; height <= to; height++ {
+				blockLogs, err := s.blockLogs(filter, height)
+				if err != nil {
+					return nil, err
+				}
+				logs = append(logs, blockLogs...)
+			}
+			continue
+		}
+		found, err := s.mipFind(filter, from, to, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, found...)
+	}
+	return logs, nil
+}
+
+func (s *State) blockLogs(filter LogFilter, height uint64) (vm.Logs, error) {
+	block, err := s.GetBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.bloomMatch(block.Bloom) {
+		return nil, nil
+	}
+	var logs vm.Logs
+	for _, txHash := range block.TxHashes {
+		receipt, err := s.GetReceipt(txHash)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, filter.filterLogs(receipt.Logs)...)
+	}
+	return logs, nil
+}
+
+func (f LogFilter) bloomMatch(bloom ethTypes.Bloom) bool {
+	if len(f.Addresses) > 0 {
+		var included bool
+		for _, addr := range f.Addresses {
+			if ethTypes.BloomLookup(bloom, addr) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, sub := range f.Topics {
+		if len(sub) == 0 {
+			continue
+		}
+		var included bool
+		for _, topic := range sub {
+			if ethTypes.BloomLookup(bloom, topic) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	return true
+}
+
+func (f LogFilter) filterLogs(logs vm.Logs) vm.Logs {
+	var ret vm.Logs
+Logs:
+	for _, log := range logs {
+		if len(f.Addresses) > 0 && !includes(f.Addresses, log.Address) {
+			continue
+		}
+		if len(f.Topics) > len(log.Topics) {
+			continue
+		}
+		for i, sub := range f.Topics {
+			if len(sub) == 0 {
+				continue
+			}
+			var match bool
+			for _, topic := range sub {
+				if log.Topics[i] == topic {
+					match = true
+					break
+				}
+			}
+			if !match {
+				continue Logs
+			}
+		}
+		ret = append(ret, log)
+	}
+	return ret
+}
+
+func includes(addresses []common.Address, a common.Address) bool {
+	for _, addr := range addresses {
+		if addr == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package tmspevm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestFilterLogs(t *testing.T) {
+	// small levels so that a few blocks cross their boundaries
+	defer func(levels []uint64) { MIPMapLevels = levels }(MIPMapLevels)
+	MIPMapLevels = []uint64{8, 4}
+
+	key, from := newTestKey(t)
+	a := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	b := common.HexToAddress("0x00000000000000000000000000000000000000b1")
+	topic0a, topic0b := common.HexToHash("0x0a"), common.HexToHash("0x0b")
+	alloc := fund(from)
+	deploy(alloc, a, "600b600a60006000a2") //LOG2 with topics 0x0a, 0x0b
+	deploy(alloc, b, "600a600b60006000a2") //LOG2 with topics 0x0b, 0x0a
+	s := newTestState(t, newTestDB(t), alloc)
+
+	nonce := uint64(0)
+	call := func(to common.Address) *ethTypes.Transaction {
+		tx := ethTypes.NewTransaction(nonce, to, new(big.Int), big.NewInt(100000), new(big.Int), nil)
+		nonce++
+		return signTx(t, s, key, tx)
+	}
+	calls := map[uint64][]common.Address{1: {a}, 2: {b}, 6: {b}, 9: {a, b}}
+	var skipped *ethTypes.Transaction
+	for height := uint64(1); height <= 10; height++ {
+		var txs []*ethTypes.Transaction
+		for _, to := range calls[height] {
+			txs = append(txs, call(to))
+		}
+		if height == 2 {
+			skipped = txs[0]
+		}
+		appendBlock(t, s, height, txs...)
+	}
+
+	for _, test := range []struct {
+		name   string
+		filter LogFilter
+		want   []common.Address
+	}{
+		{"address", LogFilter{ToBlock: 10, Addresses: []common.Address{a}}, []common.Address{a, a}},
+		{"first topic", LogFilter{ToBlock: 10, Topics: [][]common.Hash{{topic0a}}}, []common.Address{a, a}},
+		{"second topic", LogFilter{ToBlock: 10, Topics: [][]common.Hash{{}, {topic0a}}}, []common.Address{b, b, b}},
+		{"either topic", LogFilter{FromBlock: 2, ToBlock: 6, Topics: [][]common.Hash{{topic0a, topic0b}}}, []common.Address{b, b}},
+		{"address and topic", LogFilter{ToBlock: 10, Addresses: []common.Address{b}, Topics: [][]common.Hash{{topic0a}}}, nil},
+		{"range", LogFilter{FromBlock: 3, ToBlock: 8, Addresses: []common.Address{a, b}}, []common.Address{b}},
+	} {
+		logs, err := s.FilterLogs(test.filter)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(logs) != len(test.want) {
+			t.Errorf("%s: %d logs, want %d", test.name, len(logs), len(test.want))
+			continue
+		}
+		for i, log := range logs {
+			if log.Address != test.want[i] {
+				t.Errorf("%s: log %d from %x, want %x", test.name, i, log.Address, test.want[i])
+			}
+		}
+	}
+
+	// Blocks 4 to 7 only have logs of b: the MIPMap bloom skips them without
+	// reading their records. Block 2 is in a matching range but its own bloom
+	// skips it without reading its receipt.
+	for height := uint64(4); height <= 7; height++ {
+		s.db.Delete(blockHashKey(height))
+	}
+	s.db.Delete(append(receiptsPrefix, skipped.Hash().Bytes()...))
+	logs, err := s.FilterLogs(LogFilter{ToBlock: 10, Addresses: []common.Address{a}})
+	if err != nil {
+		t.Fatalf("non matching blocks were read: %v", err)
+	}
+	if len(logs) != 2 {
+		t.Errorf("%d logs of a, want 2", len(logs))
+	}
+}
@@ -0,0 +1,136 @@
+package tmspevm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	tmspTypes "github.com/tendermint/tmsp/types"
+)
+
+// Genesis is the content of the Ethereum genesis file
+type Genesis struct {
+	Config   *params.ChainConfig `json:"config"`
+	GasLimit string              `json:"gasLimit"`
+	Alloc    AccountMap          `json:"alloc"`
+}
+
+func loadGenesis(genesisFile string) (*Genesis, error) {
+	contents, err := ioutil.ReadFile(genesisFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var genesis Genesis
+	if err := json.Unmarshal(contents, &genesis); err != nil {
+		return nil, err
+	}
+	return &genesis, nil
+}
+
+// chainConfig returns the fork rules of the genesis file. Forks without an
+// activation block are active from genesis, the chain id defaults to 1 and
+// the DAO fork is only applied when both its block and support are set.
+// Scheduling a fork at a future block lets a running network upgrade at a
+// coordinated height.
+func (g *Genesis) chainConfig() params.ChainConfig {
+	var config params.ChainConfig
+	if g.Config != nil {
+		config = *g.Config
+	}
+	if config.ChainId == nil {
+		config.ChainId = big.NewInt(1)
+	}
+	if config.HomesteadBlock == nil {
+		config.HomesteadBlock = new(big.Int)
+	}
+	if config.EIP150Block == nil {
+		config.EIP150Block = new(big.Int)
+	}
+	if config.EIP155Block == nil {
+		config.EIP155Block = new(big.Int)
+	}
+	if config.EIP158Block == nil {
+		config.EIP158Block = new(big.Int)
+	}
+	return config
+}
+
+// gasLimit returns the gas limit of every block, the default one when the
+// genesis file doesn't set it. It is part of consensus.
+func (g *Genesis) gasLimit() *big.Int {
+	if g.GasLimit == "" {
+		return new(big.Int).Set(gasLimit)
+	}
+	return common.String2Big(g.GasLimit)
+}
+
+// TmGenesis is the part of the Tendermint genesis file read by the
+// application
+type TmGenesis struct {
+	AppHash    string `json:"app_hash"`
+	Validators []struct {
+		Amount int64         `json:"amount"`
+		PubKey []interface{} `json:"pub_key"`
+	} `json:"validators"`
+}
+
+func loadTmGenesis(tmGenesisFile string) (*TmGenesis, error) {
+	contents, err := ioutil.ReadFile(tmGenesisFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var genDoc TmGenesis
+	if err := json.Unmarshal(contents, &genDoc); err != nil {
+		return nil, err
+	}
+	return &genDoc, nil
+}
+
+// validators returns the genesis validators, their keys prefixed with the key
+// type like in EndBlock. Keys are written [type, "hex"] in the genesis file.
+func (g *TmGenesis) validators() ([]*tmspTypes.Validator, error) {
+	validators := make([]*tmspTypes.Validator, len(g.Validators))
+	for i, v := range g.Validators {
+		if len(v.PubKey) != 2 || v.Amount < 0 {
+			return nil, fmt.Errorf("invalid tendermint genesis validator %d", i)
+		}
+		keyType, ok := v.PubKey[0].(float64)
+		keyHex, ok2 := v.PubKey[1].(string)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid tendermint genesis validator %d", i)
+		}
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tendermint genesis validator %d: %v", i, err)
+		}
+		validators[i] = &tmspTypes.Validator{
+			PubKey: append([]byte{byte(keyType)}, key...),
+			Power:  uint64(v.Amount),
+		}
+	}
+	return validators, nil
+}
+
+// checkAppHash compares the app hash of the Ethereum genesis with the app_hash
+// of the Tendermint genesis file, when the latter is set
+func (g *TmGenesis) checkAppHash(appHash []byte) error {
+	if g.AppHash == "" {
+		return nil
+	}
+
+	expected, err := hex.DecodeString(g.AppHash)
+	if err != nil {
+		return fmt.Errorf("invalid tendermint app_hash: %v", err)
+	}
+	if !bytes.Equal(expected, appHash) {
+		return fmt.Errorf("genesis app hash mismatch: tendermint %X, ethereum %X", expected, appHash)
+	}
+	return nil
+}
@@ -2,15 +2,19 @@ package tmspevm
 
 import (
 	"encoding/json"
+	"fmt"
 	"math/big"
 	"net/http"
+	"strconv"
 
-	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
+
+	tmspTypes "github.com/tendermint/tmsp/types"
 )
 
 func accountsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
@@ -20,11 +24,17 @@ func accountsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 		return
 	}
 
+	statedb, err := state.StateAt(rpc.LatestBlockNumber)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	var al JsonAccountList
 
 	accs := m.accountManager.Accounts()
 	for _, account := range accs {
-		balance := state.GetBalance(account.Address)
+		balance := statedb.GetBalance(account.Address)
 		al.Accounts = append(al.Accounts, JsonAccount{Address: account.Address.Hex(),
 			Balance: balance})
 	}
@@ -39,41 +49,162 @@ func accountsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	w.Write(js)
 }
 
-func transactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+func accountHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	state, err := m.getState()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	param := r.URL.Path[len("/account/"):]
+	if !common.IsHexAddress(param) {
+		http.Error(w, fmt.Sprintf("invalid address: %s", param), http.StatusBadRequest)
+		return
+	}
+	address := common.HexToAddress(param)
+
+	// every field comes from the same block
+	statedb, err := state.StateAt(rpc.LatestBlockNumber)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	code := statedb.GetCode(address)
+	account := JsonAccountDetail{
+		Address:  address.Hex(),
+		Balance:  statedb.GetBalance(address),
+		Nonce:    statedb.GetNonce(address),
+		CodeHash: crypto.Keccak256Hash(code).Hex(),
+		Code:     common.ToHex(code),
+	}
+
+	// storage slots are only returned on demand, from slot storage_from
+	if count := r.URL.Query().Get("storage_count"); count != "" {
+		n, err := strconv.ParseUint(count, 0, 64)
+		if err != nil || n > maxStorageSlots {
+			http.Error(w, fmt.Sprintf("invalid storage_count, at most %d slots: %s", maxStorageSlots, count),
+				http.StatusBadRequest)
+			return
+		}
+		from := new(big.Int)
+		if param := r.URL.Query().Get("storage_from"); param != "" {
+			if _, ok := from.SetString(param, 0); !ok || from.Sign() < 0 {
+				http.Error(w, fmt.Sprintf("invalid storage_from: %s", param), http.StatusBadRequest)
+				return
+			}
+		}
+		account.Storage = make(map[string]string)
+		for i := uint64(0); i < n; i++ {
+			slot := common.BigToHash(new(big.Int).Add(from, new(big.Int).SetUint64(i)))
+			account.Storage[slot.Hex()] = statedb.GetState(address, slot).Hex()
+		}
+	}
+
+	js, err := json.Marshal(account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func transactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	decoder := json.NewDecoder(r.Body)
 	var txArgs SendTxArgs
-	err = decoder.Decode(&txArgs)
+	err := decoder.Decode(&txArgs)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
 
-	tx, err := prepareTransaction(txArgs, state, m.accountManager)
+	// wait for CheckTx unless told otherwise
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = BroadcastSync
+	}
+	tx, err := sendTransaction(txArgs, mode, m)
+	if _, failed := err.(*TxFailedError); err != nil && !failed {
+		http.Error(w, err.Error(), createTxErrorStatus(err))
+		return
+	}
+
+	js, err := json.Marshal(newJsonTxResult(tx, mode, err))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	data, err := rlp.EncodeToBytes(tx)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+
+}
+
+func rawTransactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	decoder := json.NewDecoder(r.Body)
+	var txArgs SendRawTxArgs
+	err := decoder.Decode(&txArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = BroadcastSync
+	}
+	tx, err := sendRawTransaction(common.FromHex(txArgs.Data), mode, m)
+	if _, failed := err.(*TxFailedError); err != nil && !failed {
+		http.Error(w, err.Error(), createTxErrorStatus(err))
+		return
+	}
+
+	js, err := json.Marshal(newJsonTxResult(tx, mode, err))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func callHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	state, err := m.getState()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = m.platform.CreateTransaction(data)
+	decoder := json.NewDecoder(r.Body)
+	var args CallArgs
+	err = decoder.Decode(&args)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer r.Body.Close()
 
-	res := struct{ TxHash string }{TxHash: tx.Hash().Hex()}
+	blockNr, err := parseBlockNumber(r.URL.Query().Get("block"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	output, gas, err := state.Call(args, blockNr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := struct {
+		Output  rpc.HexBytes
+		GasUsed *rpc.HexNumber
+	}{Output: output, GasUsed: rpc.NewHexNumber(gas)}
 	js, err := json.Marshal(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -82,7 +213,39 @@ func transactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
+}
 
+func estimateGasHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	state, err := m.getState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var args CallArgs
+	err = decoder.Decode(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	gas, err := state.EstimateGas(args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := struct{ Gas *rpc.HexNumber }{Gas: rpc.NewHexNumber(gas)}
+	js, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
 func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Service) {
@@ -96,28 +259,201 @@ func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Servic
 		return
 	}
 
-	tx, err := state.GetTransaction(txHash)
+	fields, err := receiptFields(txHash, state)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	receipt, err := state.GetReceipt(txHash)
+	js, err := json.Marshal(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func logsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	state, err := m.getState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var args FilterArgs
+	err = decoder.Decode(&args)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer r.Body.Close()
+
+	// both ends of the range default to the latest block
+	latest := state.LastBlockHeight()
+	filter := LogFilter{
+		FromBlock: latest,
+		ToBlock:   latest,
+		Addresses: args.Addresses,
+		Topics:    args.Topics,
+	}
+	if args.FromBlock != nil {
+		filter.FromBlock = args.FromBlock.Uint64()
+	}
+	if args.ToBlock != nil {
+		filter.ToBlock = args.ToBlock.Uint64()
+	}
 
-	signer := types.NewEIP155Signer(big.NewInt(1))
-	from, err := types.Sender(signer, tx)
+	logs, err := state.FilterLogs(filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	js, err := json.Marshal(logs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+
+// newJsonTxResult describes a broadcast transaction. In commit mode it was
+// included, with the given failure if any.
+func newJsonTxResult(tx *types.Transaction, mode string, err error) JsonTxResult {
+	res := JsonTxResult{TxHash: tx.Hash().Hex()}
+	if mode == BroadcastCommit {
+		res.Status = rpc.NewHexNumber(ReceiptStatusSuccessful)
+		if failed, ok := err.(*TxFailedError); ok {
+			res.Status = rpc.NewHexNumber(ReceiptStatusFailed)
+			res.Error = failed.Log
+		}
+	}
+	return res
+}
+
+// transactions rejected by Tendermint are the client's fault
+func createTxErrorStatus(err error) int {
+	if _, ok := err.(*TxError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// parseBlockNumber reads a block height, "latest" or "pending". The latest
+// block is the default.
+func parseBlockNumber(block string) (rpc.BlockNumber, error) {
+	switch block {
+	case "", "latest":
+		return rpc.LatestBlockNumber, nil
+	case "pending":
+		return rpc.PendingBlockNumber, nil
+	}
+	height, err := strconv.ParseUint(block, 0, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block number: %s", block)
+	}
+	return rpc.BlockNumber(height), nil
+}
+
+// sendTransaction signs a transaction with a key of the keystore and
+// broadcasts it. A transaction included with a failed status is returned
+// with a TxFailedError.
+func sendTransaction(args SendTxArgs, mode string, m *Service) (*types.Transaction, error) {
+	state, err := m.getState()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := prepareTransaction(args, state, m)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.platform.CreateTransaction(data, mode); err != nil {
+		if _, failed := err.(*TxFailedError); failed {
+			// its nonce was consumed
+			return tx, err
+		}
+		m.resetNonce(args.From)
+		return nil, err
+	}
+	return tx, nil
+}
+
+// sendRawTransaction broadcasts a transaction signed by the client once its
+// signature has been checked. A transaction included with a failed status is
+// returned with a TxFailedError.
+func sendRawTransaction(data []byte, mode string, m *Service) (*types.Transaction, error) {
+	state, err := m.getState()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(data, tx); err != nil {
+		return nil, &TxError{Code: tmspTypes.CodeType_EncodingError,
+			Log: fmt.Sprintf("invalid transaction: %v", err)}
+	}
+	if _, err := state.VerifyTransaction(tx); err != nil {
+		return nil, err
+	}
+
+	if err := m.platform.CreateTransaction(data, mode); err != nil {
+		if _, failed := err.(*TxFailedError); failed {
+			return tx, err
+		}
+		return nil, err
+	}
+	return tx, nil
+}
+
+// receiptFields describes a committed transaction and its receipt the way
+// Ethereum clients do
+func receiptFields(txHash common.Hash, state *State) (map[string]interface{}, error) {
+	tx, err := state.GetTransaction(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt, err := state.GetReceipt(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := state.GetTxLookupEntry(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := state.GetReceiptStatus(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := types.Sender(state.Signer(), tx)
+	if err != nil {
+		return nil, err
+	}
+
 	fields := map[string]interface{}{
 		"root":              rpc.HexBytes(receipt.PostState),
+		"status":            rpc.NewHexNumber(status),
+		"blockHash":         entry.BlockHash,
+		"blockNumber":       rpc.NewHexNumber(entry.BlockHeight),
 		"transactionHash":   txHash,
+		"transactionIndex":  rpc.NewHexNumber(entry.Index),
 		"from":              from,
 		"to":                tx.To(),
 		"gasUsed":           rpc.NewHexNumber(receipt.GasUsed),
@@ -133,28 +469,38 @@ func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Servic
 	if receipt.ContractAddress != (common.Address{}) {
 		fields["contractAddress"] = receipt.ContractAddress
 	}
-
-	js, err := json.Marshal(fields)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return fields, nil
 }
 
-//////////////////////////////////////////////////////////////////////////////
-
-func prepareTransaction(args SendTxArgs, state *State, accMan *accounts.Manager) (*types.Transaction, error) {
+// prepareTransaction fills in the missing fields of a transaction and signs
+// it. Only the nonce assignment and the signature hold the lock of the
+// service, not the gas estimate nor the broadcast.
+func prepareTransaction(args SendTxArgs, state *State, m *Service) (*types.Transaction, error) {
 	var err error
 	args, err = prepareSendTxArgs(args)
 	if err != nil {
 		return nil, err
 	}
 
+	if args.Gas == nil {
+		gas, err := state.EstimateGas(CallArgs{
+			From:     args.From,
+			To:       args.To,
+			GasPrice: args.GasPrice,
+			Value:    args.Value,
+			Data:     args.Data,
+		})
+		if err != nil {
+			return nil, err
+		}
+		args.Gas = rpc.NewHexNumber(gas)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
 	if args.Nonce == nil {
-		nonce := state.GetNonce(args.From)
+		nonce := m.nextNonce(args.From, state)
 		args.Nonce = rpc.NewHexNumber(nonce)
 	}
 
@@ -165,8 +511,8 @@ func prepareTransaction(args SendTxArgs, state *State, accMan *accounts.Manager)
 		tx = types.NewTransaction(args.Nonce.Uint64(), *args.To, args.Value.BigInt(), args.Gas.BigInt(), args.GasPrice.BigInt(), common.FromHex(args.Data))
 	}
 
-	signer := types.NewEIP155Signer(big.NewInt(1))
-	signature, err := accMan.SignEthereum(args.From, signer.Hash(tx).Bytes())
+	signer := state.Signer()
+	signature, err := m.accountManager.SignEthereum(args.From, signer.Hash(tx).Bytes())
 	if err != nil {
 		return nil, err
 	}
@@ -175,13 +521,11 @@ func prepareTransaction(args SendTxArgs, state *State, accMan *accounts.Manager)
 		return nil, err
 	}
 
+	m.nonces[args.From] = signedTx.Nonce() + 1
 	return signedTx, nil
 }
 
 func prepareSendTxArgs(args SendTxArgs) (SendTxArgs, error) {
-	if args.Gas == nil {
-		args.Gas = rpc.NewHexNumber(defaultGas)
-	}
 	if args.GasPrice == nil {
 		args.GasPrice = rpc.NewHexNumber(0)
 	}
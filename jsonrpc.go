@@ -0,0 +1,190 @@
+package tmspevm
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// newRPCServer exposes the service through the standard Ethereum JSON-RPC
+// namespaces so that existing tools (web3, truffle...) can talk to it
+func newRPCServer(m *Service) (*rpc.Server, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &PublicEthAPI{service: m}); err != nil {
+		return nil, err
+	}
+	if err := server.RegisterName("net", &PublicNetAPI{service: m}); err != nil {
+		return nil, err
+	}
+	if err := server.RegisterName("web3", &PublicWeb3API{}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// PublicEthAPI implements the subset of the eth namespace supported by the
+// application
+type PublicEthAPI struct {
+	service *Service
+}
+
+// Accounts returns the addresses of the keystore
+func (api *PublicEthAPI) Accounts() []common.Address {
+	accs := api.service.accountManager.Accounts()
+	addresses := make([]common.Address, len(accs))
+	for i, account := range accs {
+		addresses[i] = account.Address
+	}
+	return addresses
+}
+
+// BlockNumber returns the height of the last committed block
+func (api *PublicEthAPI) BlockNumber() (*rpc.HexNumber, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewHexNumber(state.LastBlockHeight()), nil
+}
+
+// GetBalance returns the balance of an account after the given block
+func (api *PublicEthAPI) GetBalance(address common.Address, blockNr rpc.BlockNumber) (*rpc.HexNumber, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return nil, err
+	}
+	statedb, err := state.StateAt(blockNr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewHexNumber(statedb.GetBalance(address)), nil
+}
+
+// GetTransactionCount returns the nonce of an account after the given block.
+// The pending nonce counts the transactions accepted in the mempool.
+func (api *PublicEthAPI) GetTransactionCount(address common.Address, blockNr rpc.BlockNumber) (*rpc.HexNumber, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return nil, err
+	}
+	if blockNr == rpc.PendingBlockNumber {
+		return rpc.NewHexNumber(state.GetPendingNonce(address)), nil
+	}
+	statedb, err := state.StateAt(blockNr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewHexNumber(statedb.GetNonce(address)), nil
+}
+
+// Call executes a message against the state after the given block without
+// creating a transaction and returns its output
+func (api *PublicEthAPI) Call(args CallArgs, blockNr rpc.BlockNumber) (rpc.HexBytes, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return nil, err
+	}
+	output, _, err := state.Call(args, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// EstimateGas returns the lowest gas limit with which the message succeeds
+// against the pending state
+func (api *PublicEthAPI) EstimateGas(args CallArgs) (*rpc.HexNumber, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return nil, err
+	}
+	gas, err := state.EstimateGas(args)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewHexNumber(gas), nil
+}
+
+// GetCode returns the code of a contract after the given block
+func (api *PublicEthAPI) GetCode(address common.Address, blockNr rpc.BlockNumber) (rpc.HexBytes, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return nil, err
+	}
+	statedb, err := state.StateAt(blockNr)
+	if err != nil {
+		return nil, err
+	}
+	return statedb.GetCode(address), nil
+}
+
+// GetStorageAt returns the value of a storage slot of a contract after the
+// given block
+func (api *PublicEthAPI) GetStorageAt(address common.Address, key string, blockNr rpc.BlockNumber) (common.Hash, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	statedb, err := state.StateAt(blockNr)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return statedb.GetState(address, common.HexToHash(key)), nil
+}
+
+// SendTransaction signs a transaction with a keystore account and waits for
+// CheckTx to accept it
+func (api *PublicEthAPI) SendTransaction(args SendTxArgs) (common.Hash, error) {
+	tx, err := sendTransaction(args, BroadcastSync, api.service)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+// SendRawTransaction broadcasts a transaction signed by the client and waits
+// for CheckTx to accept it
+func (api *PublicEthAPI) SendRawTransaction(encodedTx string) (common.Hash, error) {
+	tx, err := sendRawTransaction(common.FromHex(encodedTx), BroadcastSync, api.service)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+// GetTransactionReceipt returns the receipt of a committed transaction, or
+// nil if the transaction is not part of a block yet
+func (api *PublicEthAPI) GetTransactionReceipt(txHash common.Hash) (map[string]interface{}, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := state.GetTxLookupEntry(txHash); err != nil {
+		return nil, nil
+	}
+	return receiptFields(txHash, state)
+}
+
+// PublicNetAPI implements the net namespace
+type PublicNetAPI struct {
+	service *Service
+}
+
+// Version returns the chain id
+func (api *PublicNetAPI) Version() (string, error) {
+	state, err := api.service.getState()
+	if err != nil {
+		return "", err
+	}
+	return state.ChainID().String(), nil
+}
+
+// PublicWeb3API implements the web3 namespace
+type PublicWeb3API struct{}
+
+// ClientVersion returns the name of the node software
+func (api *PublicWeb3API) ClientVersion() string {
+	return fmt.Sprintf("tmsp-evm/%s-%s/%s", runtime.GOOS, runtime.GOARCH, runtime.Version())
+}
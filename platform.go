@@ -2,6 +2,8 @@ package tmspevm
 
 import (
 	"encoding/hex"
+	"fmt"
+	"strings"
 
 	cfg "github.com/tendermint/go-config"
 	"github.com/tendermint/go-logger"
@@ -10,11 +12,46 @@ import (
 	"github.com/tendermint/tendermint/node"
 	core_types "github.com/tendermint/tendermint/rpc/core/types"
 	"github.com/tendermint/tmsp/server"
+	tmspTypes "github.com/tendermint/tmsp/types"
 )
 
+// Broadcast modes of CreateTransaction
+const (
+	BroadcastAsync  = "async"  //don't wait for CheckTx
+	BroadcastSync   = "sync"   //wait for CheckTx
+	BroadcastCommit = "commit" //wait for the tx to be included in a block
+)
+
+// TxError is returned when Tendermint rejects a transaction, either in
+// CheckTx or in AppendTx
+type TxError struct {
+	Code tmspTypes.CodeType
+	Log  string
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("transaction rejected (%v): %s", e.Code, e.Log)
+}
+
+// TxFailedError is returned in commit mode for a transaction included in a
+// block with a failed status. Unlike a rejected one, its nonce and gas were
+// consumed and it has a receipt.
+type TxFailedError struct {
+	Log string
+}
+
+func (e *TxFailedError) Error() string {
+	return fmt.Sprintf("transaction failed: %s", e.Log)
+}
+
 type Config struct {
-	EthDir  string
-	ApiAddr string
+	EthDir    string
+	ApiAddr   string
+	DbBackend string //leveldb or memdb
+	ChainID   uint64 //overrides the chain id of the genesis file when set
+
+	// only serve the app and the API, Tendermint runs in its own process
+	ExternalNode bool
 
 	TmConfig cfg.Config
 }
@@ -45,12 +82,17 @@ func (p *Platform) Run() error {
 	}
 
 	proxyAddr := p.config.TmConfig.GetString("proxy_app")
-	_, err := server.NewServer(proxyAddr, "socket", p.state)
+	transport := p.config.TmConfig.GetString("tmsp") //socket or grpc
+	_, err := server.NewServer(proxyAddr, transport, p.state)
 	if err != nil {
 		return err
 	}
 
-	go node.RunNode(p.config.TmConfig)
+	if p.config.ExternalNode {
+		p.log.Info("Using external Tendermint node", "rpc", p.config.TmConfig.GetString("rpc_laddr"))
+	} else {
+		go node.RunNode(p.config.TmConfig)
+	}
 
 	if err := p.service.Init(p); err != nil {
 		return err
@@ -60,14 +102,39 @@ func (p *Platform) Run() error {
 	return nil
 }
 
-func (p *Platform) CreateTransaction(tx []byte) error {
+// CreateTransaction broadcasts a transaction to Tendermint. Depending on
+// the mode, it returns a TxError if the transaction is rejected by CheckTx
+// or AppendTx, and a TxFailedError if it is included with a failed status.
+func (p *Platform) CreateTransaction(tx []byte, mode string) error {
+	switch mode {
+	case BroadcastAsync, BroadcastSync, BroadcastCommit:
+	default:
+		return fmt.Errorf("unknown broadcast mode: %s", mode)
+	}
+
 	var result core_types.TMResult
 	params := map[string]interface{}{
 		"tx": hex.EncodeToString(tx),
 	}
-	_, err := p.client.Call("broadcast_tx_sync", params, &result)
-	return err
+	_, err := p.client.Call("broadcast_tx_"+mode, params, &result)
+	if err != nil {
+		return err
+	}
 
+	res, ok := result.(*core_types.ResultBroadcastTx)
+	if !ok {
+		return fmt.Errorf("unexpected broadcast result: %v", result)
+	}
+	if res.Code != tmspTypes.CodeType_OK {
+		p.log.Info("Transaction rejected", "code", res.Code, "log", res.Log)
+		return &TxError{Code: res.Code, Log: res.Log}
+	}
+	// in commit mode the result is the one of AppendTx
+	if mode == BroadcastCommit && strings.HasPrefix(res.Log, appendTxFailed) {
+		p.log.Info("Transaction failed", "log", res.Log)
+		return &TxFailedError{Log: strings.TrimPrefix(res.Log, appendTxFailed)}
+	}
+	return nil
 }
 
 func (p *Platform) GetState() *State {
@@ -0,0 +1,152 @@
+package tmspevm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	tmspTypes "github.com/tendermint/tmsp/types"
+)
+
+var emptyCodeHash = crypto.Keccak256(nil)
+
+// QueryResult is the answer to a Query, read from the last committed state.
+// AccountProof holds the trie nodes from the state root to the account,
+// keyed by the hash of its address. StorageProof holds the trie nodes from
+// the storage root of the account to the slot, keyed by the hash of the slot.
+// The app hash is the hash of the state, transactions and receipts roots.
+type QueryResult struct {
+	Height       uint64         `json:"height"`
+	AppHash      rpc.HexBytes   `json:"appHash"`
+	StateRoot    common.Hash    `json:"stateRoot"`
+	TxRoot       common.Hash    `json:"txRoot"`
+	ReceiptRoot  common.Hash    `json:"receiptRoot"`
+	Value        rpc.HexBytes   `json:"value"`
+	AccountProof []rpc.HexBytes `json:"accountProof"`
+	StorageProof []rpc.HexBytes `json:"storageProof,omitempty"`
+}
+
+// Query for state. Supported paths are
+//
+//	/account/<addr>        RLP encoded account
+//	/code/<addr>           contract code, its hash is in the account
+//	/storage/<addr>/<slot> value of a storage slot
+func (s *State) Query(query []byte) tmspTypes.Result {
+	s.log.Debug("Query", "query", string(query))
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
+	path := strings.Split(strings.Trim(string(query), "/"), "/")
+	if len(path) < 2 || !common.IsHexAddress(path[1]) {
+		return tmspTypes.NewError(tmspTypes.CodeType_UnknownRequest,
+			fmt.Sprintf("Query unknown path: %s", query))
+	}
+	address := common.HexToAddress(path[1])
+
+	res := &QueryResult{
+		Height:      s.lastCommit.Height,
+		AppHash:     s.lastCommit.AppHash,
+		StateRoot:   s.lastCommit.Root,
+		TxRoot:      s.lastCommit.TxRoot,
+		ReceiptRoot: s.lastCommit.ReceiptRoot,
+	}
+	enc, account, err := s.proveAccount(address, res)
+	if err != nil {
+		s.log.Error("Query", "error", err)
+		return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
+			fmt.Sprintf("Query account: %v", err))
+	}
+
+	switch {
+	case path[0] == "account" && len(path) == 2:
+		res.Value = enc
+	case path[0] == "code" && len(path) == 2:
+		res.Value, err = s.getCode(account)
+	case path[0] == "storage" && len(path) == 3:
+		res.Value, err = s.proveStorage(account, common.HexToHash(path[2]), res)
+	default:
+		return tmspTypes.NewError(tmspTypes.CodeType_UnknownRequest,
+			fmt.Sprintf("Query unknown path: %s", query))
+	}
+	if err != nil {
+		s.log.Error("Query", "error", err)
+		return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
+			fmt.Sprintf("Query: %v", err))
+	}
+
+	js, err := json.Marshal(res)
+	if err != nil {
+		return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
+			fmt.Sprintf("Query encoding: %v", err))
+	}
+	return tmspTypes.NewResultOK(js, "")
+}
+
+// proveAccount reads an account from the committed account trie, along with
+// its proof. A missing account is returned empty with a proof of absence.
+func (s *State) proveAccount(address common.Address, res *QueryResult) ([]byte, *state.Account, error) {
+	tr, err := trie.New(s.lastCommit.Root, s.db)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := crypto.Keccak256(address.Bytes())
+	enc, err := tr.TryGet(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	res.AccountProof = toHexBytes(tr.Prove(key))
+
+	var account state.Account
+	if len(enc) > 0 {
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			return nil, nil, err
+		}
+	}
+	return enc, &account, nil
+}
+
+// proveStorage reads a slot from the storage trie of the account, along with
+// its proof
+func (s *State) proveStorage(account *state.Account, slot common.Hash, res *QueryResult) ([]byte, error) {
+	tr, err := trie.New(account.Root, s.db)
+	if err != nil {
+		return nil, err
+	}
+	key := crypto.Keccak256(slot.Bytes())
+	enc, err := tr.TryGet(key)
+	if err != nil {
+		return nil, err
+	}
+	res.StorageProof = toHexBytes(tr.Prove(key))
+
+	var value common.Hash
+	if len(enc) > 0 {
+		_, content, _, err := rlp.Split(enc)
+		if err != nil {
+			return nil, err
+		}
+		value = common.BytesToHash(content)
+	}
+	return value.Bytes(), nil
+}
+
+func (s *State) getCode(account *state.Account) ([]byte, error) {
+	if len(account.CodeHash) == 0 || common.BytesToHash(account.CodeHash) == common.BytesToHash(emptyCodeHash) {
+		return nil, nil
+	}
+	return s.db.Get(account.CodeHash)
+}
+
+func toHexBytes(proof []rlp.RawValue) []rpc.HexBytes {
+	nodes := make([]rpc.HexBytes, len(proof))
+	for i, node := range proof {
+		nodes[i] = rpc.HexBytes(node)
+	}
+	return nodes
+}
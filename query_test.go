@@ -0,0 +1,109 @@
+package tmspevm
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+func query(t *testing.T, s *State, path string) *QueryResult {
+	res := s.Query([]byte(path))
+	if res.IsErr() {
+		t.Fatalf("Query %s: %v", path, res)
+	}
+	var qr QueryResult
+	if err := json.Unmarshal(res.Data, &qr); err != nil {
+		t.Fatalf("Query %s: %v", path, err)
+	}
+	// the roots are those the validators signed
+	if !bytes.Equal(appHash(qr.StateRoot, qr.TxRoot, qr.ReceiptRoot), qr.AppHash) {
+		t.Errorf("Query %s: roots don't hash to the app hash %X", path, []byte(qr.AppHash))
+	}
+	if !bytes.Equal(qr.AppHash, s.lastCommit.AppHash) {
+		t.Errorf("Query %s: app hash %X, want the committed %X", path, []byte(qr.AppHash), s.lastCommit.AppHash)
+	}
+	return &qr
+}
+
+func verifyProof(t *testing.T, root common.Hash, key []byte, proof []rpc.HexBytes) []byte {
+	nodes := make([]rlp.RawValue, len(proof))
+	for i, node := range proof {
+		nodes[i] = rlp.RawValue(node)
+	}
+	value, err := trie.VerifyProof(root, crypto.Keccak256(key), nodes)
+	if err != nil {
+		t.Fatalf("invalid proof of %x: %v", key, err)
+	}
+	return value
+}
+
+func TestQueryAccountProof(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	_, absent := newTestKey(t)
+	s := newTestState(t, newTestDB(t), fund(from))
+	committed := appendBlock(t, s, 1, transfer(t, s, key, 0, to, 1000))
+
+	qr := query(t, s, "/account/"+to.Hex())
+	if !bytes.Equal(qr.AppHash, committed) {
+		t.Errorf("app hash %X, want %X returned by Commit", []byte(qr.AppHash), committed)
+	}
+	value := verifyProof(t, qr.StateRoot, to.Bytes(), qr.AccountProof)
+	if !bytes.Equal(value, qr.Value) {
+		t.Errorf("proven account %x, answered %x", value, []byte(qr.Value))
+	}
+	var account state.Account
+	if err := rlp.DecodeBytes(value, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance.Int64() != 1000 {
+		t.Errorf("proven balance %v, want 1000", account.Balance)
+	}
+
+	qr = query(t, s, "/account/"+absent.Hex())
+	if value := verifyProof(t, qr.StateRoot, absent.Bytes(), qr.AccountProof); value != nil || len(qr.Value) != 0 {
+		t.Errorf("missing account proven as %x, answered %x", value, []byte(qr.Value))
+	}
+}
+
+func TestQueryStorageProof(t *testing.T) {
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000ee")
+	alloc := make(AccountMap)
+	deploy(alloc, contract, "00")
+	account := alloc[contract.Hex()]
+	account.Storage = map[string]string{"0x01": "0x2a"}
+	alloc[contract.Hex()] = account
+	s := newTestState(t, newTestDB(t), alloc)
+
+	slot := common.HexToHash("0x01")
+	qr := query(t, s, "/storage/"+contract.Hex()+"/"+slot.Hex())
+	var proven state.Account
+	if err := rlp.DecodeBytes(verifyProof(t, qr.StateRoot, contract.Bytes(), qr.AccountProof), &proven); err != nil {
+		t.Fatal(err)
+	}
+	enc := verifyProof(t, proven.Root, slot.Bytes(), qr.StorageProof)
+	_, content, _, err := rlp.Split(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := common.BytesToHash(content); value != common.HexToHash("0x2a") || value != common.BytesToHash(qr.Value) {
+		t.Errorf("proven slot %x, answered %x, want 0x2a", value, []byte(qr.Value))
+	}
+
+	// an empty slot is proven absent from the storage trie
+	empty := common.HexToHash("0x02")
+	qr = query(t, s, "/storage/"+contract.Hex()+"/"+empty.Hex())
+	if enc := verifyProof(t, proven.Root, empty.Bytes(), qr.StorageProof); enc != nil {
+		t.Errorf("empty slot proven as %x", enc)
+	}
+	if common.BytesToHash(qr.Value) != (common.Hash{}) {
+		t.Errorf("empty slot answered %x", []byte(qr.Value))
+	}
+}
@@ -1,23 +1,24 @@
 package tmspevm
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/gorilla/mux"
 	"github.com/tendermint/go-logger"
 	"github.com/tendermint/log15"
 )
 
-const defaultGas = uint64(90000)
+// maxStorageSlots bounds the storage slots returned with an account
+const maxStorageSlots = 256
 
 type Service struct {
-	sync.Mutex
+	sync.Mutex     //guards nonces
+	nonces         map[common.Address]uint64
 	platform       *Platform
 	dataDir        string
 	apiAddr        string
@@ -27,6 +28,7 @@ type Service struct {
 
 func NewService(dataDir, apiAddr string) *Service {
 	return &Service{
+		nonces:  make(map[common.Address]uint64),
 		dataDir: dataDir,
 		apiAddr: apiAddr,
 		log:     logger.New("module", "service")}
@@ -42,8 +44,6 @@ func (m *Service) Run() {
 
 	m.checkErr(m.unlockAccounts())
 
-	m.checkErr(m.createGenesisAccounts())
-
 	m.log.Info("serving api...")
 	m.serveAPI()
 }
@@ -63,31 +63,6 @@ func (m *Service) makeAccountManager() error {
 	return nil
 }
 
-func (m *Service) createGenesisAccounts() error {
-	genesisFile := filepath.Join(m.dataDir, "genesis.json")
-
-	contents, err := ioutil.ReadFile(genesisFile)
-	if err != nil {
-		return err
-	}
-
-	var genesis struct {
-		Alloc AccountMap
-	}
-
-	if err := json.Unmarshal(contents, &genesis); err != nil {
-		return err
-	}
-	state, err := m.getState()
-	if err != nil {
-		return err
-	}
-	if err := state.CreateAccounts(genesis.Alloc); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (m *Service) unlockAccounts() error {
 	accs := m.accountManager.Accounts()
 	for _, account := range accs {
@@ -103,21 +78,49 @@ func (m *Service) getState() (*State, error) {
 }
 
 func (m *Service) serveAPI() {
+	rpcServer, err := newRPCServer(m)
+	m.checkErr(err)
+
 	router := mux.NewRouter()
+	router.Handle("/", rpcServer).Methods("POST")
 	router.HandleFunc("/accounts", m.makeHandler(accountsHandler)).Methods("GET")
+	router.HandleFunc("/account/{addr}", m.makeHandler(accountHandler)).Methods("GET")
 	router.HandleFunc("/tx", m.makeHandler(transactionHandler)).Methods("POST")
+	router.HandleFunc("/rawtx", m.makeHandler(rawTransactionHandler)).Methods("POST")
+	router.HandleFunc("/call", m.makeHandler(callHandler)).Methods("POST")
+	router.HandleFunc("/estimate", m.makeHandler(estimateGasHandler)).Methods("POST")
 	router.HandleFunc("/tx/{tx_hash}", m.makeHandler(transactionReceiptHandler)).Methods("GET")
+	router.HandleFunc("/logs", m.makeHandler(logsHandler)).Methods("POST")
 	http.ListenAndServe(m.apiAddr, router)
 }
 
+// makeHandler binds a handler to the service. Handlers run concurrently, the
+// state has its own lock.
 func (m *Service) makeHandler(fn func(http.ResponseWriter, *http.Request, *Service)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		m.Lock()
 		fn(w, r, m)
-		m.Unlock()
 	}
 }
 
+// nextNonce returns the nonce of the next transaction of a keystore account:
+// the pending nonce, or the one after the last transaction signed by the
+// service if CheckTx hasn't seen it yet. The service must be locked.
+func (m *Service) nextNonce(addr common.Address, state *State) uint64 {
+	nonce := state.GetPendingNonce(addr)
+	if next, ok := m.nonces[addr]; ok && next > nonce {
+		return next
+	}
+	return nonce
+}
+
+// resetNonce forgets the transactions signed for an account once one of them
+// was rejected, the next one starts again from the pending nonce
+func (m *Service) resetNonce(addr common.Address) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.nonces, addr)
+}
+
 func (m *Service) checkErr(err error) {
 	if err != nil {
 		m.log.Error("ERROR", err)
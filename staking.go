@@ -0,0 +1,200 @@
+package tmspevm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	tmspTypes "github.com/tendermint/tmsp/types"
+)
+
+// Operations of the staking contract, the first byte of the call data
+const (
+	stakingBond   = byte(0x01)
+	stakingUnbond = byte(0x02)
+
+	ed25519PubKeyType = byte(0x01) //go-wire type byte of ed25519 public keys
+	ed25519PubKeySize = 32
+)
+
+var (
+	// StakingAddress is the system contract where accounts bond ether to
+	// validators. It is handled natively, without EVM code:
+	//	data = 0x01 || pubkey  bonds the value of the transaction to pubkey
+	//	data = 0x02 || pubkey  returns everything the sender bonded to pubkey
+	// pubkey is the 32 bytes ed25519 key of a validator. The voting power of
+	// a validator is its genesis power plus the ether bonded to it, in units
+	// of PowerUnit. A bond is at least PowerUnit, so bonding never removes a
+	// validator, and nobody can unbond the genesis power.
+	StakingAddress = common.HexToAddress("0x0000000000000000000000000000000000000100")
+	PowerUnit      = big.NewInt(1000000000000000000)
+	MinBond        = PowerUnit
+
+	// number of validators with a voting power, the set can't be emptied
+	validatorCountKey = crypto.Keccak256Hash([]byte("validators"))
+
+	errStakingData          = errors.New("staking: invalid call data")
+	errStakingValue         = errors.New("staking: bond value must be at least MinBond and unbond value zero")
+	errStakingNoBond        = errors.New("staking: nothing bonded")
+	errStakingLastValidator = errors.New("staking: can't remove the last validator")
+)
+
+func isStakingTx(to *common.Address) bool {
+	return to != nil && *to == StakingAddress
+}
+
+// validateStakingTx checks the call data and value of a transaction sent to
+// the staking contract
+func validateStakingTx(data []byte, value *big.Int) error {
+	if len(data) != 1+ed25519PubKeySize {
+		return errStakingData
+	}
+	switch data[0] {
+	case stakingBond:
+		if value.Cmp(MinBond) < 0 {
+			return errStakingValue
+		}
+	case stakingUnbond:
+		if value.Sign() != 0 {
+			return errStakingValue
+		}
+	default:
+		return errStakingData
+	}
+	return nil
+}
+
+// the amount bonded by an account to a validator
+func bondKey(pubKey []byte, addr common.Address) common.Hash {
+	return crypto.Keccak256Hash(pubKey, addr.Bytes())
+}
+
+// the total amount bonded to a validator
+func totalBondKey(pubKey []byte) common.Hash {
+	return crypto.Keccak256Hash(pubKey)
+}
+
+// the voting power of a validator with the given total bond
+func votingPower(total *big.Int) uint64 {
+	return new(big.Int).Div(total, PowerUnit).Uint64()
+}
+
+// setGenesisValidators gives the validators of the Tendermint genesis their
+// power in the staking contract. Nobody owns these bonds. The contract gets a
+// nonce so that EIP158 never deletes it as an empty account.
+func setGenesisValidators(statedb *state.StateDB, validators []*tmspTypes.Validator) error {
+	count := new(big.Int)
+	for _, v := range validators {
+		if len(v.PubKey) != 1+ed25519PubKeySize || v.PubKey[0] != ed25519PubKeyType {
+			return fmt.Errorf("staking: unsupported genesis validator key %X", v.PubKey)
+		}
+		if v.Power == 0 {
+			continue
+		}
+		total := new(big.Int).Mul(new(big.Int).SetUint64(v.Power), PowerUnit)
+		statedb.SetState(StakingAddress, totalBondKey(v.PubKey[1:]), common.BigToHash(total))
+		count.Add(count, common.Big1)
+	}
+	statedb.SetState(StakingAddress, validatorCountKey, common.BigToHash(count))
+	statedb.SetNonce(StakingAddress, 1)
+	return nil
+}
+
+// updateBonds updates the bonds once the value of the transaction was
+// transferred to the staking contract and returns the validator whose bond
+// changed. Nothing is changed when it fails.
+func updateBonds(statedb vm.StateDB, msg core.Message) ([]byte, error) {
+	if err := validateStakingTx(msg.Data(), msg.Value()); err != nil {
+		return nil, err
+	}
+	op, pubKey := msg.Data()[0], msg.Data()[1:]
+	from := msg.From()
+
+	bond := statedb.GetState(StakingAddress, bondKey(pubKey, from)).Big()
+	total := statedb.GetState(StakingAddress, totalBondKey(pubKey)).Big()
+	count := statedb.GetState(StakingAddress, validatorCountKey).Big()
+	before := votingPower(total)
+	switch op {
+	case stakingBond:
+		bond.Add(bond, msg.Value())
+		total.Add(total, msg.Value())
+	case stakingUnbond:
+		if bond.Sign() == 0 {
+			return nil, errStakingNoBond
+		}
+		total.Sub(total, bond)
+	}
+	switch after := votingPower(total); {
+	case before == 0 && after > 0:
+		count.Add(count, common.Big1)
+	case before > 0 && after == 0:
+		if count.Cmp(common.Big1) <= 0 {
+			return nil, errStakingLastValidator
+		}
+		count.Sub(count, common.Big1)
+	}
+
+	if op == stakingUnbond {
+		statedb.SubBalance(StakingAddress, bond)
+		statedb.AddBalance(from, bond)
+		bond = new(big.Int)
+	}
+	statedb.SetState(StakingAddress, bondKey(pubKey, from), common.BigToHash(bond))
+	statedb.SetState(StakingAddress, totalBondKey(pubKey), common.BigToHash(total))
+	statedb.SetState(StakingAddress, validatorCountKey, common.BigToHash(count))
+	return pubKey, nil
+}
+
+// applyStaking updates the bonds of the write ahead state and records the
+// validator whose power changed
+func (was *WriteAheadState) applyStaking(msg core.Message) error {
+	pubKey, err := updateBonds(was.state, msg)
+	if err != nil {
+		return err
+	}
+
+	for _, changed := range was.validators {
+		if string(changed) == string(pubKey) {
+			return nil
+		}
+	}
+	was.validators = append(was.validators, common.CopyBytes(pubKey))
+	return nil
+}
+
+// validatorUpdates converts validator diffs for the block record
+func validatorUpdates(diffs []*tmspTypes.Validator) []ValidatorUpdate {
+	updates := make([]ValidatorUpdate, len(diffs))
+	for i, v := range diffs {
+		updates[i] = ValidatorUpdate{PubKey: v.PubKey, Power: v.Power}
+	}
+	return updates
+}
+
+// validatorDiffs returns the validator updates recorded with the block
+func (b *Block) validatorDiffs() []*tmspTypes.Validator {
+	diffs := make([]*tmspTypes.Validator, len(b.Validators))
+	for i, v := range b.Validators {
+		diffs[i] = &tmspTypes.Validator{PubKey: v.PubKey, Power: v.Power}
+	}
+	return diffs
+}
+
+// validatorDiffs returns the new power of the validators whose bonds changed
+// during the block, in the order they were first changed
+func (was *WriteAheadState) validatorDiffs() []*tmspTypes.Validator {
+	diffs := make([]*tmspTypes.Validator, len(was.validators))
+	for i, pubKey := range was.validators {
+		total := was.state.GetState(StakingAddress, totalBondKey(pubKey)).Big()
+		diffs[i] = &tmspTypes.Validator{
+			PubKey: append([]byte{ed25519PubKeyType}, pubKey...),
+			Power:  votingPower(total),
+		}
+	}
+	return diffs
+}
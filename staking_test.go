@@ -0,0 +1,120 @@
+package tmspevm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	tmspTypes "github.com/tendermint/tmsp/types"
+)
+
+// stakingTx signs a call of the staking contract, op being stakingBond or
+// stakingUnbond
+func stakingTx(t *testing.T, s *State, key *ecdsa.PrivateKey, nonce uint64, op byte, pubKey []byte, value *big.Int) *ethTypes.Transaction {
+	data := append([]byte{op}, pubKey...)
+	tx := ethTypes.NewTransaction(nonce, StakingAddress, value, big.NewInt(100000), new(big.Int), data)
+	return signTx(t, s, key, tx)
+}
+
+// runBlock runs a whole block and returns its validator updates
+func runBlock(t *testing.T, s *State, height uint64, txs ...*ethTypes.Transaction) []*tmspTypes.Validator {
+	beginBlock(s, height)
+	for _, tx := range txs {
+		if res := s.AppendTx(encodeTx(t, tx)); res.IsErr() {
+			t.Fatalf("AppendTx %x: %v", tx.Hash(), res)
+		}
+	}
+	diffs := s.EndBlock(height)
+	if res := s.Commit(); res.IsErr() {
+		t.Fatalf("Commit %d: %v", height, res)
+	}
+	return diffs
+}
+
+func checkPower(t *testing.T, diffs []*tmspTypes.Validator, pubKey []byte, power uint64) {
+	key := append([]byte{ed25519PubKeyType}, pubKey...)
+	for _, v := range diffs {
+		if bytes.Equal(v.PubKey, key) {
+			if v.Power != power {
+				t.Errorf("power of %X is %d, want %d", pubKey, v.Power, power)
+			}
+			return
+		}
+	}
+	t.Errorf("no update of %X, want power %d", pubKey, power)
+}
+
+func TestStakingGenesisPower(t *testing.T) {
+	key, from := newTestKey(t)
+	pubKey := bytes.Repeat([]byte{0x11}, ed25519PubKeySize)
+	genesis := []*tmspTypes.Validator{{PubKey: append([]byte{ed25519PubKeyType}, pubKey...), Power: 10}}
+	s := newTestStateWithValidators(t, newTestDB(t), fund(from), genesis)
+
+	// a bond below MinBond would give no power
+	dust := stakingTx(t, s, key, 0, stakingBond, pubKey, big.NewInt(1))
+	if res := s.CheckTx(encodeTx(t, dust)); res.Code != CodeType_InvalidStakingTx {
+		t.Errorf("CheckTx of a 1 wei bond: %v", res)
+	}
+
+	bond := stakingTx(t, s, key, 0, stakingBond, pubKey, MinBond)
+	checkPower(t, runBlock(t, s, 1, bond), pubKey, 11)
+
+	// unbonding gives back the bond, not the genesis power
+	unbond := stakingTx(t, s, key, 1, stakingUnbond, pubKey, new(big.Int))
+	checkPower(t, runBlock(t, s, 2, unbond), pubKey, 10)
+	if balance := s.GetBalance(StakingAddress); balance.Sign() != 0 {
+		t.Errorf("staking balance %v, want 0", balance)
+	}
+
+	// the genesis power isn't owned by anyone
+	again := stakingTx(t, s, key, 2, stakingUnbond, pubKey, new(big.Int))
+	if diffs := runBlock(t, s, 3, again); len(diffs) != 0 {
+		t.Errorf("unbonding the genesis power updated %v", diffs)
+	}
+}
+
+func TestStakingLastValidator(t *testing.T) {
+	key, from := newTestKey(t)
+	pubKey := bytes.Repeat([]byte{0x22}, ed25519PubKeySize)
+	s := newTestState(t, newTestDB(t), fund(from))
+
+	bond := stakingTx(t, s, key, 0, stakingBond, pubKey, MinBond)
+	checkPower(t, runBlock(t, s, 1, bond), pubKey, 1)
+
+	// the only validator can't unbond
+	unbond := stakingTx(t, s, key, 1, stakingUnbond, pubKey, new(big.Int))
+	if diffs := runBlock(t, s, 2, unbond); len(diffs) != 0 {
+		t.Errorf("unbonding the last validator updated %v", diffs)
+	}
+	if status, err := s.GetReceiptStatus(unbond.Hash()); err != nil || status != ReceiptStatusFailed {
+		t.Errorf("status of the unbond %d (%v), want %d", status, err, ReceiptStatusFailed)
+	}
+	if balance := s.GetBalance(StakingAddress); balance.Cmp(MinBond) != 0 {
+		t.Errorf("staking balance %v, want %v", balance, MinBond)
+	}
+}
+
+func TestStakingReplayedBlock(t *testing.T) {
+	key, from := newTestKey(t)
+	pubKey := bytes.Repeat([]byte{0x33}, ed25519PubKeySize)
+	db := newTestDB(t)
+	s := newTestState(t, db, fund(from))
+
+	bond := stakingTx(t, s, key, 0, stakingBond, pubKey, MinBond)
+	checkPower(t, runBlock(t, s, 1, bond), pubKey, 1)
+	appHash := s.lastCommit.AppHash
+
+	// Tendermint crashed after the commit and runs the block again on a
+	// restarted application
+	s = newTestState(t, db, fund(from))
+	beginBlock(s, 1)
+	if res := s.AppendTx(encodeTx(t, bond)); res.IsErr() {
+		t.Fatalf("AppendTx: %v", res)
+	}
+	checkPower(t, s.EndBlock(1), pubKey, 1)
+	if res := s.Commit(); res.IsErr() || !bytes.Equal(res.Data, appHash) {
+		t.Errorf("replayed commit %v, want app hash %X", res, appHash)
+	}
+}
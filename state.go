@@ -2,8 +2,11 @@ package tmspevm
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/big"
+	"path/filepath"
+	"strconv"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -15,16 +18,53 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
 
 	"github.com/tendermint/go-logger"
 	"github.com/tendermint/log15"
 	tmspTypes "github.com/tendermint/tmsp/types"
 )
 
+const (
+	databaseCache   = 128  // MB of memory allocated to the LevelDB cache
+	databaseHandles = 1024 // number of open file handles for LevelDB
+
+	maxTxSize = 32 * 1024
+)
+
+// Result codes of the transactions rejected by CheckTx, outside of the ranges
+// reserved by TMSP. Bad nonces, insufficient funds and wrong chain ids use
+// the general TMSP codes.
+const (
+	CodeType_OversizedData    tmspTypes.CodeType = 301
+	CodeType_InvalidSignature tmspTypes.CodeType = 302
+	CodeType_GasLimit         tmspTypes.CodeType = 303
+	CodeType_NegativeValue    tmspTypes.CodeType = 304
+	CodeType_IntrinsicGas     tmspTypes.CodeType = 305
+	CodeType_GasPriceTooLow   tmspTypes.CodeType = 306
+	CodeType_InvalidStakingTx tmspTypes.CodeType = 307
+)
+
+// appendTxFailed starts the log of the transactions included with a failed
+// status, AppendTx still answers OK since they are part of the block
+const appendTxFailed = "AppendTx failed: "
+
+// Status of the transactions included in a block. Failed transactions, either
+// before or during execution, are charged their gas and their nonce is
+// consumed.
+const (
+	ReceiptStatusFailed     = uint64(0)
+	ReceiptStatusSuccessful = uint64(1)
+)
+
 var (
-	gasLimit       = big.NewInt(1000000000000000000)
+	secp256k1HalfN = new(big.Int).Div(crypto.S256().Params().N, big.NewInt(2))
+
+	gasLimit       = big.NewInt(1000000000000000000) //default block gas limit
 	txMetaSuffix   = []byte{0x01}
 	receiptsPrefix = []byte("receipts-")
+	statusPrefix   = []byte("receipt-status-")
+	lastCommitKey  = []byte("LastCommit")
 	MIPMapLevels   = []uint64{1000000, 500000, 100000, 50000, 1000}
 )
 
@@ -34,12 +74,20 @@ type State struct {
 	db          ethdb.Database
 	commitMutex sync.Mutex
 	statedb     *state.StateDB
+	checkState  *state.StateDB //mempool view, advanced by CheckTx
 	was         *WriteAheadState
+	lastCommit  commitInfo
+	restored    bool
 
 	signer      ethTypes.Signer
 	chainConfig params.ChainConfig //vm.env is still tightly coupled with chainConfig
 	vmConfig    vm.Config
 
+	blockGasLimit *big.Int //from the genesis file
+
+	// runtime options, see SetOption
+	minGasPrice *big.Int
+
 	log log15.Logger
 }
 
@@ -49,27 +97,101 @@ type WriteAheadState struct {
 	db    ethdb.Database
 	state *state.StateDB
 
+	height     uint64      //height of the block being processed
+	hash       common.Hash //Tendermint hash of the block being processed
+	time       uint64
+	parentHash common.Hash
+	replay     bool //the block was already committed
+
 	txIndex      int
 	transactions []*ethTypes.Transaction
 	receipts     ethTypes.Receipts
+	statuses     []uint64
 	allLogs      vm.Logs
+	validators   [][]byte //public keys whose bonds changed
 
 	totalUsedGas *big.Int
+	gasLimit     *big.Int
 	gp           *core.GasPool
 
 	log log15.Logger
 }
 
-func (s *State) Init(platform *Platform) error {
-	s.log = logger.New("module", "evmstate")
+// commitInfo is persisted on every Commit so that a restarted node can
+// reopen its last state and report how far it got.
+type commitInfo struct {
+	Height      uint64
+	BlockHash   common.Hash
+	AppHash     []byte
+	Root        common.Hash
+	TxRoot      common.Hash
+	ReceiptRoot common.Hash
+}
+
+// appHash commits to the state, the transactions and the receipts of a block,
+// so validators that disagree on gas accounting or logs halt the chain
+func appHash(root, txRoot, receiptRoot common.Hash) []byte {
+	return crypto.Keccak256(root.Bytes(), txRoot.Bytes(), receiptRoot.Bytes())
+}
 
-	var err error
+func (s *State) Init(platform *Platform) error {
 	s.platform = platform
-	s.db, err = ethdb.NewMemDatabase() //ephemeral database
+	db, err := openDatabase(platform.config)
+	if err != nil {
+		return err
+	}
+
+	genesis, err := loadGenesis(filepath.Join(platform.config.EthDir, "genesis.json"))
 	if err != nil {
 		return err
 	}
-	state, err := state.New(common.Hash{}, s.db)
+	chainConfig := genesis.chainConfig()
+	if platform.config.ChainID != 0 {
+		chainConfig.ChainId = new(big.Int).SetUint64(platform.config.ChainID)
+	}
+
+	// an external node's genesis file must be copied, see --tm_genesis
+	tmGenesisFile := platform.config.TmConfig.GetString("genesis_file")
+	tmGenesis, err := loadTmGenesis(tmGenesisFile)
+	if err != nil {
+		return fmt.Errorf("cannot read tendermint genesis %s: %v", tmGenesisFile, err)
+	}
+	validators, err := tmGenesis.validators()
+	if err != nil {
+		return err
+	}
+
+	if err := s.open(db, genesis, chainConfig, validators); err != nil {
+		return err
+	}
+	if s.lastCommit.Height == 0 {
+		if err := tmGenesis.checkAppHash(s.lastCommit.AppHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open loads the last committed state from the database, or creates the
+// genesis accounts and validators in an empty one
+func (s *State) open(db ethdb.Database, genesis *Genesis, chainConfig params.ChainConfig, validators []*tmspTypes.Validator) error {
+	s.log = logger.New("module", "evmstate")
+	s.minGasPrice = new(big.Int)
+	s.blockGasLimit = genesis.gasLimit()
+	if s.blockGasLimit.Sign() <= 0 {
+		return fmt.Errorf("invalid genesis gas limit: %q", genesis.GasLimit)
+	}
+	s.db = db
+
+	// reopen the last committed state if there is one
+	if data, err := s.db.Get(lastCommitKey); err == nil {
+		if err := rlp.DecodeBytes(data, &s.lastCommit); err != nil {
+			return fmt.Errorf("cannot decode last commit: %v", err)
+		}
+		s.restored = true
+		s.log.Info("Restoring state", "height", s.lastCommit.Height, "root", s.lastCommit.Root.Hex())
+	}
+	state, err := state.New(s.lastCommit.Root, s.db)
 	if err != nil {
 		return err
 	}
@@ -77,22 +199,93 @@ func (s *State) Init(platform *Platform) error {
 	s.statedb = state
 	s.resetWAS(state.Copy())
 
-	s.signer = ethTypes.NewEIP155Signer(big.NewInt(1))
-	s.chainConfig = params.ChainConfig{big.NewInt(1), new(big.Int), new(big.Int), true, new(big.Int), common.Hash{}, new(big.Int), new(big.Int)}
-	s.vmConfig = vm.Config{Tracer: vm.NewStructLogger(nil)}
+	s.chainConfig = chainConfig
+	s.log.Info("Chain", "id", s.chainConfig.ChainId,
+		"gasLimit", s.blockGasLimit,
+		"homestead", s.chainConfig.HomesteadBlock,
+		"eip150", s.chainConfig.EIP150Block,
+		"eip155", s.chainConfig.EIP155Block,
+		"eip158", s.chainConfig.EIP158Block,
+		"daoFork", s.chainConfig.DAOForkBlock)
+
+	// the genesis accounts are created once, before the TMSP server accepts
+	// connections
+	if !s.restored {
+		if err := setGenesisValidators(s.was.state, validators); err != nil {
+			return err
+		}
+		if err := s.CreateAccounts(genesis.Alloc); err != nil {
+			return err
+		}
+	}
+
+	s.signer = ethTypes.MakeSigner(&s.chainConfig, new(big.Int).SetUint64(s.was.height))
+	s.vmConfig = vm.Config{}
 	return nil
 }
 
 // Applications --------------------------------------------------------------
 
-// Return application info
+// Return application info, with the height and app hash of the last
+// committed block. The pinned TMSP only passes the info string along:
+// Tendermint 0.7 doesn't parse it and doesn't replay the blocks the app is
+// missing, it is only meant for operators. Restarts rely on BeginBlock
+// skipping the blocks that were already committed.
 func (s *State) Info() (info string) {
-	return "tmsp-evm"
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
+	js, err := json.Marshal(struct {
+		Name        string `json:"name"`
+		LastHeight  uint64 `json:"last_block_height"`
+		LastAppHash string `json:"last_block_app_hash"`
+	}{
+		Name:        "tmsp-evm",
+		LastHeight:  s.lastCommit.Height,
+		LastAppHash: fmt.Sprintf("%X", s.lastCommit.AppHash),
+	})
+	if err != nil {
+		s.log.Error("Encoding info", "error", err)
+		return "tmsp-evm"
+	}
+	return string(js)
 }
 
-// Set application option (e.g. mode=mempool, mode=consensus)
+// Set application option. The supported keys are
+//
+//	min_gas_price    lowest gas price accepted by CheckTx (wei)
+//	vm_trace         print a trace of the EVM execution (true or false)
+//	log_level        debug, info, notice, warn, error or crit
+//
+// None of them is part of consensus. The block gas limit is, it is set in the
+// genesis file.
 func (s *State) SetOption(key string, value string) (log string) {
-	return "not implemented"
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
+	switch key {
+	case "min_gas_price":
+		price, ok := new(big.Int).SetString(value, 0)
+		if !ok || price.Sign() < 0 {
+			return fmt.Sprintf("Error: invalid min_gas_price %q", value)
+		}
+		s.minGasPrice = price
+	case "vm_trace":
+		trace, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Sprintf("Error: invalid vm_trace %q", value)
+		}
+		s.vmConfig.Debug = trace
+	case "log_level":
+		if _, err := log15.LvlFromString(value); err != nil {
+			return fmt.Sprintf("Error: invalid log_level %q", value)
+		}
+		logger.SetLogLevel(value)
+	default:
+		return fmt.Sprintf("Error: unknown option %q", key)
+	}
+	s.log.Notice("Set option", "key", key, "value", value)
+	return ""
 }
 
 // Append a tx
@@ -101,6 +294,10 @@ func (s *State) AppendTx(tx []byte) tmspTypes.Result {
 	s.commitMutex.Lock()
 	defer s.commitMutex.Unlock()
 
+	if s.was.replay {
+		return tmspTypes.OK
+	}
+
 	var t ethTypes.Transaction
 	if err := rlp.Decode(bytes.NewReader(tx), &t); err != nil {
 		s.log.Error("Decoding transaction", "error", err)
@@ -113,34 +310,66 @@ func (s *State) AppendTx(tx []byte) tmspTypes.Result {
 	}
 	s.log.Debug("Decoded tx", "hash", t.Hash().Hex())
 
-	context := vm.Context{
-		CanTransfer: core.CanTransfer,
-		Transfer:    core.Transfer,
-		GetHash:     func(uint64) common.Hash { return common.Hash{} },
-		// Message information
-		Origin:   msg.From(),
-		GasPrice: msg.GasPrice(),
-	}
+	// Logs emitted by the tx are recorded under its hash
+	s.was.state.StartRecord(t.Hash(), s.was.hash, s.was.txIndex)
 	// Environment provides information about external sources for the EVM
 	// The Environment should never be reused and is not thread safe.
-	vmenv := vm.NewEnvironment(context, s.was.state, &s.chainConfig, s.vmConfig)
+	vmConfig := s.vmConfig
+	if vmConfig.Debug {
+		vmConfig.Tracer = vm.NewStructLogger(nil)
+	}
+	snapshot := s.was.state.Snapshot()
+	statedb := newRevertRecorder(s.was.state)
+	vmenv := vm.NewEnvironment(s.vmContext(msg), statedb, &s.chainConfig, vmConfig)
 	// Apply the transaction to the current state (included in the env)
+	availableGas := new(big.Int).Set((*big.Int)(s.was.gp))
+	status := ReceiptStatusSuccessful
 	_, gas, err := core.ApplyMessage(vmenv, msg, s.was.gp)
+	if err == nil && statedb.reverted {
+		// The execution failed and its changes were undone by the EVM, which
+		// still charged the gas and consumed the nonce.
+		s.log.Info("Transaction reverted", "hash", t.Hash().Hex())
+		status = ReceiptStatusFailed
+	} else if err == nil && isStakingTx(msg.To()) {
+		err = s.was.applyStaking(msg)
+	}
 	if err != nil {
-		s.log.Error("Applying transaction to WAS", "error", err)
-		return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
-			fmt.Sprintf("AppendTx ApplyMessage: %v", err))
+		// A transaction with a wrong nonce or more gas than the block has
+		// left can't be charged. It is left out of the block.
+		if core.IsNonceErr(err) || core.IsGasLimitErr(err) {
+			s.log.Error("Applying transaction to WAS", "error", err)
+			return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
+				fmt.Sprintf("AppendTx ApplyMessage: %v", err))
+		}
+		// Any other failure is undone and the transaction is included as
+		// failed.
+		s.log.Info("Transaction failed", "hash", t.Hash().Hex(), "error", err)
+		s.was.state.RevertToSnapshot(snapshot)
+		(*big.Int)(s.was.gp).Set(availableGas)
+		if err := s.was.gp.SubGas(msg.Gas()); err != nil {
+			s.log.Error("Applying transaction to WAS", "error", err)
+			return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
+				fmt.Sprintf("AppendTx ApplyMessage: %v", err))
+		}
+		gas = chargeFailedTx(s.was.state, msg, vmenv.Context.Coinbase)
+		status = ReceiptStatusFailed
+	}
+
+	if vmConfig.Debug {
+		vm.StdErrFormat(vmConfig.Tracer.(*vm.StructLogger).StructLogs())
 	}
 
 	s.was.totalUsedGas.Add(s.was.totalUsedGas, gas)
 
 	// Create a new receipt for the transaction, storing the intermediate root and gas used by the tx
 	// based on the eip phase, we're passing wether the root touch-delete accounts.
-	receipt := ethTypes.NewReceipt(s.statedb.IntermediateRoot(true).Bytes(), s.was.totalUsedGas)
+	// The root is the one of the write ahead state, after the tx was applied.
+	deleteEmpty := s.chainConfig.IsEIP158(vmenv.Context.BlockNumber)
+	receipt := ethTypes.NewReceipt(s.was.state.IntermediateRoot(deleteEmpty).Bytes(), s.was.totalUsedGas)
 	receipt.TxHash = t.Hash()
 	receipt.GasUsed = new(big.Int).Set(gas)
 	// if the transaction created a contract, store the creation address in the receipt.
-	if msg.To() == nil {
+	if msg.To() == nil && status == ReceiptStatusSuccessful {
 		receipt.ContractAddress = crypto.CreateAddress(vmenv.Context.Origin, t.Nonce())
 	}
 	// Set the receipt logs and create a bloom for filtering
@@ -150,15 +379,27 @@ func (s *State) AppendTx(tx []byte) tmspTypes.Result {
 	s.was.txIndex += 1
 	s.was.transactions = append(s.was.transactions, &t)
 	s.was.receipts = append(s.was.receipts, receipt)
+	s.was.statuses = append(s.was.statuses, status)
 	s.was.allLogs = append(s.was.allLogs, receipt.Logs...)
 
 	s.log.Debug("Applied tx to WAS", "hash", t.Hash().Hex())
+	if statedb.reverted {
+		return tmspTypes.NewResultOK(nil, appendTxFailed+"execution reverted")
+	}
+	if status == ReceiptStatusFailed {
+		return tmspTypes.NewResultOK(nil, fmt.Sprintf("%s%v", appendTxFailed, err))
+	}
 	return tmspTypes.OK
 }
 
-// Validate a tx for the mempool
+// Validate a tx for the mempool. The check state keeps track of the pending
+// nonces and balances so that transactions from the same sender can follow
+// each other before being committed.
 func (s *State) CheckTx(tx []byte) tmspTypes.Result {
 	s.log.Debug("CheckTx")
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
 	var t ethTypes.Transaction
 	if err := rlp.Decode(bytes.NewReader(tx), &t); err != nil {
 		s.log.Error("Decoding tx", "error", err)
@@ -166,24 +407,190 @@ func (s *State) CheckTx(tx []byte) tmspTypes.Result {
 	}
 	s.log.Debug("Decoded tx", "hash", t.Hash().Hex())
 
-	from, err := ethTypes.Sender(s.signer, &t)
+	if t.GasPrice().Cmp(s.minGasPrice) < 0 {
+		s.log.Error("Gas price too low", "price", t.GasPrice(), "min", s.minGasPrice)
+		return tmspTypes.NewError(CodeType_GasPriceTooLow,
+			fmt.Sprintf("CheckTx gas price too low: %v < %v", t.GasPrice(), s.minGasPrice))
+	}
+
+	from, res := s.validateTx(&t, s.checkState)
+	if res.IsErr() {
+		return res
+	}
+
+	s.checkState.SetNonce(from, t.Nonce()+1)
+	s.checkState.SubBalance(from, t.Cost())
+
+	s.log.Debug("Checked tx", "hash", t.Hash().Hex())
+	return tmspTypes.OK
+}
+
+// Return the application hash. It commits to the state root and to the roots
+// of the transactions and receipts tries of the block.
+func (s *State) Commit() tmspTypes.Result {
+	s.log.Info("Commit")
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
+	// the block was committed before a restart, its state is already on disk
+	// and its app hash is the one of its own record
+	if s.was.replay {
+		block, err := s.GetBlock(s.was.height)
+		if err != nil {
+			s.log.Error("Replayed block not found", "height", s.was.height, "error", err)
+			return tmspTypes.ErrInternalError
+		}
+		s.resetWAS(s.statedb.Copy())
+		return tmspTypes.NewResultOK(appHash(block.StateRoot, block.TxHash, block.ReceiptHash), "")
+	}
+
+	// state, transactions, receipts and the last commit marker are written
+	// in a single batch so a failure can't leave a partial block behind
+	batch := s.db.NewBatch()
+
+	deleteEmpty := s.chainConfig.IsEIP158(new(big.Int).SetUint64(s.was.height))
+	block, err := s.was.Commit(batch, deleteEmpty)
+	if err != nil {
+		s.log.Error("Committing WAS", "error", err)
+		return tmspTypes.ErrInternalError
+	}
+
+	info := commitInfo{
+		Height:      block.Height,
+		BlockHash:   block.Hash,
+		AppHash:     appHash(block.StateRoot, block.TxHash, block.ReceiptHash),
+		Root:        block.StateRoot,
+		TxRoot:      block.TxHash,
+		ReceiptRoot: block.ReceiptHash,
+	}
+	if err := putCommitInfo(batch, info); err != nil {
+		s.log.Error("Writing last commit", "error", err)
+		return tmspTypes.ErrInternalError
+	}
+
+	if err := batch.Write(); err != nil {
+		s.log.Error("Writing batch", "error", err)
+		return tmspTypes.ErrInternalError
+	}
+	s.lastCommit = info
+
+	// reset the write ahead state for the next block
+	// with the latest eth state
+	s.statedb = s.was.state
+	s.log.Info("Committed", "root", info.Root.Hex(), "appHash", common.ToHex(info.AppHash))
+
+	s.resetWAS(s.statedb.Copy())
+	return tmspTypes.NewResultOK(info.AppHash, "")
+}
+
+// BlockchainAware -----------------------------------------------------------
+
+// Initialize blockchain. The genesis accounts and validators are already
+// created by Init, from the genesis files.
+func (s *State) InitChain(validators []*tmspTypes.Validator) {
+}
+
+// Signals the beginning of a block. The header provides the block context
+// of the EVM for the transactions that follow.
+func (s *State) BeginBlock(hash []byte, header *tmspTypes.Header) {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
+	s.was.height = header.GetHeight()
+	s.was.hash = common.BytesToHash(hash)
+	s.was.time = header.GetTime()
+
+	// the signer follows the fork rules of the block
+	number := new(big.Int).SetUint64(s.was.height)
+	s.signer = ethTypes.MakeSigner(&s.chainConfig, number)
+
+	// Tendermint replays the last block if it crashed before saving its own
+	// state. Applying it twice would corrupt ours, so it is skipped.
+	if s.was.height <= s.lastCommit.Height {
+		s.log.Warn("Block already committed", "height", s.was.height, "last", s.lastCommit.Height)
+		s.was.replay = true
+		return
+	}
+
+	if s.chainConfig.DAOForkSupport && s.chainConfig.DAOForkBlock != nil && s.chainConfig.DAOForkBlock.Cmp(number) == 0 {
+		s.log.Notice("Applying DAO hard fork", "height", s.was.height)
+		core.ApplyDAOHardFork(s.was.state)
+	}
+}
+
+// Signals the end of a block. The validators whose bonds changed in the
+// staking contract are returned with their new power, a replayed block
+// returns the ones recorded when it was committed. Tendermint 0.7 only logs
+// them, it doesn't change its validator set.
+func (s *State) EndBlock(height uint64) (diffs []*tmspTypes.Validator) {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+
+	if s.was.replay {
+		block, err := s.GetBlock(s.was.height)
+		if err != nil {
+			s.log.Error("Replayed block not found", "height", s.was.height, "error", err)
+			return nil
+		}
+		return block.validatorDiffs()
+	}
+
+	diffs = s.was.validatorDiffs()
+	for _, v := range diffs {
+		s.log.Notice("Validator update", "pubKey", fmt.Sprintf("%X", v.PubKey), "power", v.Power)
+	}
+	return diffs
+}
+
+//----------------------------------------------------------------------------
+
+// validateTx runs the checks of core.ApplyMessage that don't need the EVM
+// against the given state, so that transactions which would fail in AppendTx
+// never reach the mempool. It returns the sender of the transaction.
+func (s *State) validateTx(t *ethTypes.Transaction, statedb *state.StateDB) (common.Address, tmspTypes.Result) {
+	homestead := s.chainConfig.IsHomestead(new(big.Int).SetUint64(s.was.height))
+
+	// Heuristic limit, reject transactions over 32KB to prevent DOS attacks
+	if t.Size() > maxTxSize {
+		s.log.Error("Oversized data", "size", t.Size())
+		return common.Address{}, tmspTypes.NewError(CodeType_OversizedData,
+			fmt.Sprintf("CheckTx oversized data: %v", t.Size()))
+	}
+
+	// Transactions replay protected for another chain are rejected
+	if t.Protected() && t.ChainId().Cmp(s.chainConfig.ChainId) != 0 {
+		s.log.Error("Wrong chain id", "chainId", t.ChainId())
+		return common.Address{}, tmspTypes.NewError(tmspTypes.CodeType_Unauthorized,
+			fmt.Sprintf("CheckTx invalid chain id: %v", t.ChainId()))
+	}
+
+	// Since Homestead signatures with a high s value are malleable
+	if _, _, sv := t.RawSignatureValues(); homestead && sv.Cmp(secp256k1HalfN) > 0 {
+		s.log.Error("Malleable signature")
+		return common.Address{}, tmspTypes.NewError(CodeType_InvalidSignature,
+			"CheckTx invalid signature: s value over half the curve order")
+	}
+
+	from, err := ethTypes.Sender(s.signer, t)
 	if err != nil {
 		s.log.Error("Extracting tx sender", "error", err)
-		return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
+		return common.Address{}, tmspTypes.NewError(CodeType_InvalidSignature,
 			fmt.Sprintf("CheckTx invalid sender: %v", err))
 	}
 
-	if s.was.state.GetNonce(from) > t.Nonce() {
-		s.log.Error("Bad nonce")
-		return tmspTypes.ErrBadNonce
+	// Transactions must follow each other, a future nonce would hold back
+	// every transaction of the sender until the gap is filled
+	if nonce := statedb.GetNonce(from); nonce != t.Nonce() {
+		s.log.Error("Bad nonce", "expected", nonce, "nonce", t.Nonce())
+		return from, tmspTypes.NewError(tmspTypes.CodeType_BadNonce,
+			fmt.Sprintf("CheckTx bad nonce: expected %d, got %d", nonce, t.Nonce()))
 	}
 
-	// Check the transaction doesn't exceed the current
-	// block limit gas.
-	if (*big.Int)(s.was.gp).Cmp(t.Gas()) < 0 {
-		s.log.Error("Not enough gas")
-		return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
-			fmt.Sprintf("CheckTx gas limit: %v", err))
+	// Check the transaction doesn't exceed the block gas limit
+	if s.was.gasLimit.Cmp(t.Gas()) < 0 {
+		s.log.Error("Exceeds block gas limit")
+		return from, tmspTypes.NewError(CodeType_GasLimit,
+			fmt.Sprintf("CheckTx gas limit: %v", t.Gas()))
 	}
 
 	// Transactions can't be negative. This may never happen
@@ -191,64 +598,159 @@ func (s *State) CheckTx(tx []byte) tmspTypes.Result {
 	// a transaction using the RPC for example.
 	if t.Value().Cmp(common.Big0) < 0 {
 		s.log.Error("Negative value")
-		return tmspTypes.NewError(tmspTypes.CodeType_InternalError,
-			fmt.Sprintf("CheckTx negative value: %v", err))
+		return from, tmspTypes.NewError(CodeType_NegativeValue,
+			fmt.Sprintf("CheckTx negative value: %v", t.Value()))
 	}
 
 	// Transactor should have enough funds to cover the costs
 	// cost == V + GP * GL
-	if s.was.state.GetBalance(from).Cmp(t.Cost()) < 0 {
+	if statedb.GetBalance(from).Cmp(t.Cost()) < 0 {
 		s.log.Error("Insufficient funds")
-		return tmspTypes.ErrInsufficientFunds
+		return from, tmspTypes.ErrInsufficientFunds
 	}
 
-	//XXX: Check intinsic gas
-	s.log.Debug("Checked tx", "hash", t.Hash().Hex())
-	return tmspTypes.OK
+	if isStakingTx(t.To()) {
+		if err := validateStakingTx(t.Data(), t.Value()); err != nil {
+			s.log.Error("Invalid staking tx", "error", err)
+			return from, tmspTypes.NewError(CodeType_InvalidStakingTx,
+				fmt.Sprintf("CheckTx %v", err))
+		}
+	}
+
+	// The gas limit must cover the base cost of the transaction
+	intrGas := core.IntrinsicGas(t.Data(), t.To() == nil, homestead)
+	if t.Gas().Cmp(intrGas) < 0 {
+		s.log.Error("Intrinsic gas too low", "gas", t.Gas(), "intrinsic", intrGas)
+		return from, tmspTypes.NewError(CodeType_IntrinsicGas,
+			fmt.Sprintf("CheckTx intrinsic gas too low: %v < %v", t.Gas(), intrGas))
+	}
+
+	return from, tmspTypes.OK
 }
 
-// Query for state
-func (s *State) Query(query []byte) tmspTypes.Result {
-	return tmspTypes.NewResultOK(nil, "not implemented")
+// revertRecorder tells whether the EVM reverted the changes of the message it
+// runs. The pinned EVM doesn't return execution errors (out of gas, invalid
+// jump or opcode...) but the outermost call or create reverts to the first
+// snapshot taken during the message when it fails.
+type revertRecorder struct {
+	*state.StateDB
+	first    int
+	taken    bool
+	reverted bool
 }
 
-// Return the application Merkle root hash
-func (s *State) Commit() tmspTypes.Result {
-	s.log.Info("Commit")
-	s.commitMutex.Lock()
-	defer s.commitMutex.Unlock()
+func newRevertRecorder(statedb *state.StateDB) *revertRecorder {
+	return &revertRecorder{StateDB: statedb}
+}
 
-	//commit all state changes to the database
-	hashArray, err := s.was.Commit()
-	if err != nil {
-		s.log.Error("Committing WAS", "error", err)
-		return tmspTypes.ErrInternalError
+func (r *revertRecorder) Snapshot() int {
+	id := r.StateDB.Snapshot()
+	if !r.taken {
+		r.first, r.taken = id, true
+	}
+	return id
+}
+
+func (r *revertRecorder) RevertToSnapshot(id int) {
+	if r.taken && id == r.first {
+		r.reverted = true
 	}
+	r.StateDB.RevertToSnapshot(id)
+}
 
-	// reset the write ahead state for the next block
-	// with the latest eth state
-	s.statedb = s.was.state
-	s.log.Info("Committed", "root", hashArray.Hex())
+// chargeFailedTx consumes the nonce and the gas limit of a transaction that
+// failed before execution. The fee, capped by the balance of the sender, goes
+// to the coinbase.
+func chargeFailedTx(statedb *state.StateDB, msg core.Message, coinbase common.Address) *big.Int {
+	from := msg.From()
+	fee := new(big.Int).Mul(msg.Gas(), msg.GasPrice())
+	if balance := statedb.GetBalance(from); balance.Cmp(fee) < 0 {
+		fee.Set(balance)
+	}
+	statedb.SubBalance(from, fee)
+	statedb.AddBalance(coinbase, fee)
+	statedb.SetNonce(from, statedb.GetNonce(from)+1)
+	return new(big.Int).Set(msg.Gas())
+}
 
-	s.resetWAS(s.statedb.Copy())
-	return tmspTypes.NewResultOK(hashArray.Bytes(), "")
+// vmContext describes the block being processed and the message to the EVM
+func (s *State) vmContext(msg core.Message) vm.Context {
+	context := s.blockContext()
+	// Message information
+	context.Origin = msg.From()
+	context.GasPrice = msg.GasPrice()
+	return context
 }
 
-//----------------------------------------------------------------------------
+// blockContext is the part of the EVM context set by the block being built.
+// There is no mining, so the coinbase collecting fees is the same on every
+// node and the difficulty is zero.
+func (s *State) blockContext() vm.Context {
+	return vm.Context{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GetHash:     s.getHashFn(),
+		// Block information
+		Coinbase:    common.Address{},
+		GasLimit:    new(big.Int).Set(s.was.gasLimit),
+		BlockNumber: new(big.Int).SetUint64(s.was.height),
+		Time:        new(big.Int).SetUint64(s.was.time),
+		Difficulty:  new(big.Int),
+	}
+}
+
+// getHashFn looks up the hashes of committed blocks for the BLOCKHASH opcode
+func (s *State) getHashFn() func(n uint64) common.Hash {
+	return func(n uint64) common.Hash {
+		hash, err := s.GetBlockHash(n)
+		if err != nil {
+			return common.Hash{}
+		}
+		return hash
+	}
+}
+
+// openDatabase creates the database selected by the config. LevelDB data lives
+// under <datadir>/eth/chaindata and survives restarts.
+func openDatabase(config Config) (ethdb.Database, error) {
+	switch config.DbBackend {
+	case "memdb":
+		return ethdb.NewMemDatabase() //ephemeral database
+	case "", "leveldb":
+		return ethdb.NewLDBDatabase(filepath.Join(config.EthDir, "chaindata"), databaseCache, databaseHandles)
+	default:
+		return nil, fmt.Errorf("unknown database backend: %s", config.DbBackend)
+	}
+}
 
 // runs in Commit once we have the new state
 func (s *State) resetWAS(state *state.StateDB) {
 	s.was = &WriteAheadState{
 		db:           s.db,
 		state:        state,
+		height:       s.lastCommit.Height + 1,
+		parentHash:   s.lastCommit.BlockHash,
 		txIndex:      0,
 		totalUsedGas: big.NewInt(0),
-		gp:           new(core.GasPool).AddGas(gasLimit),
+		gasLimit:     new(big.Int).Set(s.blockGasLimit),
+		gp:           new(core.GasPool).AddGas(s.blockGasLimit),
 		log:          s.log,
 	}
+	// the mempool starts over from the committed state, Tendermint rechecks
+	// the transactions it still holds
+	s.checkState = s.statedb.Copy()
 	s.log.Notice("Reset Write Ahead State")
 }
 
+// schedule the height and hashes of the last commit in the batch
+func putCommitInfo(batch ethdb.Batch, info commitInfo) error {
+	data, err := rlp.EncodeToBytes(info)
+	if err != nil {
+		return err
+	}
+	return batch.Put(lastCommitKey, data)
+}
+
 func (s *State) CreateAccounts(accounts AccountMap) error {
 	s.commitMutex.Lock()
 	defer s.commitMutex.Unlock()
@@ -262,10 +764,39 @@ func (s *State) CreateAccounts(accounts AccountMap) error {
 		}
 		s.log.Info("Adding account", "address", addr)
 	}
-	_, err := s.was.state.Commit(true)
+	batch := s.db.NewBatch()
+	root, err := s.was.state.CommitTo(batch, true)
 	if err != nil {
 		return fmt.Errorf("cannot write state: %v", err)
 	}
+	// the genesis state is recorded as a block without transactions so that
+	// height 0 can be queried like any other
+	genesis := &Block{
+		Height:      s.lastCommit.Height,
+		Hash:        s.lastCommit.BlockHash,
+		StateRoot:   root,
+		GasUsed:     new(big.Int),
+		TxHash:      ethTypes.EmptyRootHash,
+		ReceiptHash: ethTypes.EmptyRootHash,
+	}
+	if err := putBlock(batch, genesis); err != nil {
+		return fmt.Errorf("cannot write genesis block: %v", err)
+	}
+	info := commitInfo{
+		Height:      s.lastCommit.Height,
+		BlockHash:   s.lastCommit.BlockHash,
+		AppHash:     appHash(root, ethTypes.EmptyRootHash, ethTypes.EmptyRootHash),
+		Root:        root,
+		TxRoot:      ethTypes.EmptyRootHash,
+		ReceiptRoot: ethTypes.EmptyRootHash,
+	}
+	if err := putCommitInfo(batch, info); err != nil {
+		return fmt.Errorf("cannot write last commit: %v", err)
+	}
+	if err := batch.Write(); err != nil {
+		return fmt.Errorf("cannot write batch: %v", err)
+	}
+	s.lastCommit = info
 
 	s.statedb = s.was.state
 	s.resetWAS(s.statedb.Copy())
@@ -273,14 +804,108 @@ func (s *State) CreateAccounts(accounts AccountMap) error {
 	return nil
 }
 
+// Signer is used to sign and verify all the transactions of the chain. It
+// follows the fork rules of the block being built, set by BeginBlock, which
+// is the earliest block a transaction signed now can enter. Once EIP155 is
+// active the signer still accepts unprotected signatures, so transactions
+// signed before a scheduled activation stay valid after it.
+func (s *State) Signer() ethTypes.Signer {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+	return s.signer
+}
+
+// VerifyTransaction checks that a transaction signed outside of the node is
+// meant for this chain and returns its sender
+func (s *State) VerifyTransaction(tx *ethTypes.Transaction) (common.Address, error) {
+	if tx.Protected() && tx.ChainId().Cmp(s.chainConfig.ChainId) != 0 {
+		return common.Address{}, &TxError{Code: tmspTypes.CodeType_Unauthorized,
+			Log: fmt.Sprintf("invalid chain id: %v", tx.ChainId())}
+	}
+	from, err := ethTypes.Sender(s.Signer(), tx)
+	if err != nil {
+		return common.Address{}, &TxError{Code: CodeType_InvalidSignature,
+			Log: fmt.Sprintf("invalid sender: %v", err)}
+	}
+	return from, nil
+}
+
+// LastBlockHeight returns the height of the last committed block
+func (s *State) LastBlockHeight() uint64 {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+	return s.lastCommit.Height
+}
+
+// ChainID is the EIP155 chain id signed into the transactions
+func (s *State) ChainID() *big.Int {
+	return s.chainConfig.ChainId
+}
+
+// StateAt returns a copy of the state after the given block. The pending state
+// includes the transactions of the block being built.
+func (s *State) StateAt(blockNr rpc.BlockNumber) (*state.StateDB, error) {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+	return s.stateAt(blockNr)
+}
+
+// stateAt is StateAt for callers holding the lock
+func (s *State) stateAt(blockNr rpc.BlockNumber) (*state.StateDB, error) {
+	switch {
+	case blockNr == rpc.PendingBlockNumber:
+		return s.was.state.Copy(), nil
+	case blockNr == rpc.LatestBlockNumber || uint64(blockNr) == s.lastCommit.Height:
+		return s.statedb.Copy(), nil
+	case uint64(blockNr) > s.lastCommit.Height:
+		return nil, fmt.Errorf("block %d is not committed yet, last block is %d", blockNr, s.lastCommit.Height)
+	}
+	block, err := s.GetBlock(uint64(blockNr))
+	if err != nil {
+		return nil, fmt.Errorf("unknown block %d", blockNr)
+	}
+	return state.New(block.StateRoot, s.db)
+}
+
+// GetBalance returns the balance of an account after the last block. Several
+// reads that must agree go through a StateAt snapshot instead.
 func (s *State) GetBalance(addr common.Address) *big.Int {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
 	return s.statedb.GetBalance(addr)
 }
 
+// GetNonce returns the nonce of an account after the last block
 func (s *State) GetNonce(addr common.Address) uint64 {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
 	return s.statedb.GetNonce(addr)
 }
 
+// GetCode returns the code of a contract after the last block, empty for
+// other accounts
+func (s *State) GetCode(addr common.Address) []byte {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+	return s.statedb.GetCode(addr)
+}
+
+// GetStorageAt returns the value of a storage slot of a contract after the
+// last block
+func (s *State) GetStorageAt(addr common.Address, key common.Hash) common.Hash {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+	return s.statedb.GetState(addr, key)
+}
+
+// GetPendingNonce returns the nonce of the next transaction of an account,
+// counting the transactions accepted in the mempool
+func (s *State) GetPendingNonce(addr common.Address) uint64 {
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+	return s.checkState.GetNonce(addr)
+}
+
 func (s *State) GetTransaction(hash common.Hash) (*ethTypes.Transaction, error) {
 	// Retrieve the transaction itself from the database
 	data, err := s.db.Get(hash.Bytes())
@@ -297,6 +922,21 @@ func (s *State) GetTransaction(hash common.Hash) (*ethTypes.Transaction, error)
 	return &tx, nil
 }
 
+// GetReceiptStatus tells whether a committed transaction failed
+func (s *State) GetReceiptStatus(txHash common.Hash) (uint64, error) {
+	data, err := s.db.Get(append(statusPrefix, txHash[:]...))
+	if err != nil {
+		s.log.Error("GetReceiptStatus", "error", err)
+		return 0, fmt.Errorf("get-receipt-status: %v", err)
+	}
+	var status uint64
+	if err := rlp.DecodeBytes(data, &status); err != nil {
+		s.log.Error("GetReceiptStatus", "error", err)
+		return 0, err
+	}
+	return status, nil
+}
+
 func (s *State) GetReceipt(txHash common.Hash) (*ethTypes.Receipt, error) {
 	data, err := s.db.Get(append(receiptsPrefix, txHash[:]...))
 	if err != nil {
@@ -312,28 +952,38 @@ func (s *State) GetReceipt(txHash common.Hash) (*ethTypes.Receipt, error) {
 	return (*ethTypes.Receipt)(&receipt), nil
 }
 
-func (was *WriteAheadState) Commit() (common.Hash, error) {
-	//commit all state changes to the database
-	hashArray, err := was.state.Commit(true)
+// Commit schedules all the changes of the block in the batch and returns the
+// block record. Nothing reaches the database before the batch is written.
+// Empty accounts are deleted from the state once EIP158 is active.
+func (was *WriteAheadState) Commit(batch ethdb.Batch, deleteEmptyObjects bool) (*Block, error) {
+	//commit all state changes to the batch
+	root, err := was.state.CommitTo(batch, deleteEmptyObjects)
 	if err != nil {
 		was.log.Error("Committing WAS", "error", err)
-		return common.Hash{}, tmspTypes.ErrInternalError
+		return nil, err
 	}
-	if err := was.writeTransactions(); err != nil {
+	if err := was.writeTransactions(batch); err != nil {
 		was.log.Error("Writing txs", "error", err)
-		return common.Hash{}, tmspTypes.ErrInternalError
+		return nil, err
 	}
-	if err := was.writeReceipts(); err != nil {
+	if err := was.writeReceipts(batch); err != nil {
 		was.log.Error("Writing receipts", "error", err)
-		return common.Hash{}, tmspTypes.ErrInternalError
+		return nil, err
+	}
+	block, err := was.writeBlock(batch, root)
+	if err != nil {
+		was.log.Error("Writing block", "error", err)
+		return nil, err
+	}
+	if err := was.writeMipmapBlooms(batch); err != nil {
+		was.log.Error("Writing mipmap blooms", "error", err)
+		return nil, err
 	}
-	return hashArray, nil
+	return block, nil
 }
 
-func (was *WriteAheadState) writeTransactions() error {
-	batch := was.db.NewBatch()
-
-	for _, tx := range was.transactions {
+func (was *WriteAheadState) writeTransactions(batch ethdb.Batch) error {
+	for i, tx := range was.transactions {
 		data, err := rlp.EncodeToBytes(tx)
 		if err != nil {
 			return err
@@ -341,16 +991,20 @@ func (was *WriteAheadState) writeTransactions() error {
 		if err := batch.Put(tx.Hash().Bytes(), data); err != nil {
 			return err
 		}
+		entry := TxLookupEntry{
+			BlockHash:   was.hash,
+			BlockHeight: was.height,
+			Index:       uint64(i),
+		}
+		if err := putTxLookupEntry(batch, tx.Hash(), entry); err != nil {
+			return err
+		}
 	}
-
-	// Write the scheduled data into the database
-	return batch.Write()
+	return nil
 }
 
-func (was *WriteAheadState) writeReceipts() error {
-	batch := was.db.NewBatch()
-
-	for _, receipt := range was.receipts {
+func (was *WriteAheadState) writeReceipts(batch ethdb.Batch) error {
+	for i, receipt := range was.receipts {
 		storageReceipt := (*ethTypes.ReceiptForStorage)(receipt)
 		data, err := rlp.EncodeToBytes(storageReceipt)
 		if err != nil {
@@ -359,7 +1013,34 @@ func (was *WriteAheadState) writeReceipts() error {
 		if err := batch.Put(append(receiptsPrefix, receipt.TxHash.Bytes()...), data); err != nil {
 			return err
 		}
+		status, err := rlp.EncodeToBytes(was.statuses[i])
+		if err != nil {
+			return err
+		}
+		if err := batch.Put(append(statusPrefix, receipt.TxHash.Bytes()...), status); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return batch.Write()
+func (was *WriteAheadState) writeBlock(batch ethdb.Batch, root common.Hash) (*Block, error) {
+	txHashes := make([]common.Hash, len(was.transactions))
+	for i, tx := range was.transactions {
+		txHashes[i] = tx.Hash()
+	}
+	block := &Block{
+		Height:      was.height,
+		Hash:        was.hash,
+		Time:        was.time,
+		ParentHash:  was.parentHash,
+		StateRoot:   root,
+		TxHashes:    txHashes,
+		GasUsed:     was.totalUsedGas,
+		Bloom:       ethTypes.CreateBloom(was.receipts),
+		TxHash:      ethTypes.DeriveSha(ethTypes.Transactions(was.transactions)),
+		ReceiptHash: ethTypes.DeriveSha(was.receipts),
+		Validators:  validatorUpdates(was.validatorDiffs()),
+	}
+	return block, putBlock(batch, block)
 }
@@ -0,0 +1,513 @@
+package tmspevm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	tmspTypes "github.com/tendermint/tmsp/types"
+)
+
+var testBalance = "1000000000000000000000" // 1000 ether
+
+// newTestState opens a State over the database with the default chain config
+// of an empty genesis file and no genesis validators
+func newTestState(t *testing.T, db ethdb.Database, alloc AccountMap) *State {
+	return newTestStateWithValidators(t, db, alloc, nil)
+}
+
+func newTestStateWithValidators(t *testing.T, db ethdb.Database, alloc AccountMap, validators []*tmspTypes.Validator) *State {
+	s := new(State)
+	genesis := &Genesis{Alloc: alloc}
+	if err := s.open(db, genesis, genesis.chainConfig(), validators); err != nil {
+		t.Fatalf("cannot open state: %v", err)
+	}
+	return s
+}
+
+func newTestDB(t *testing.T) *ethdb.MemDatabase {
+	db, err := ethdb.NewMemDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, common.Address) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, crypto.PubkeyToAddress(key.PublicKey)
+}
+
+// fund returns the genesis allocation of testBalance to every address
+func fund(addrs ...common.Address) AccountMap {
+	alloc := make(AccountMap)
+	for _, addr := range addrs {
+		account := alloc[addr.Hex()]
+		account.Balance = testBalance
+		alloc[addr.Hex()] = account
+	}
+	return alloc
+}
+
+// deploy adds a genesis contract with the hex encoded code
+func deploy(alloc AccountMap, addr common.Address, code string) {
+	account := alloc[addr.Hex()]
+	account.Code = code
+	account.Balance = "0"
+	alloc[addr.Hex()] = account
+}
+
+func signTx(t *testing.T, s *State, key *ecdsa.PrivateKey, tx *ethTypes.Transaction) *ethTypes.Transaction {
+	signed, err := ethTypes.SignTx(tx, s.Signer(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func encodeTx(t *testing.T, tx *ethTypes.Transaction) []byte {
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// transfer signs a transfer of value wei with the intrinsic gas and no fee
+func transfer(t *testing.T, s *State, key *ecdsa.PrivateKey, nonce uint64, to common.Address, value int64) *ethTypes.Transaction {
+	tx := ethTypes.NewTransaction(nonce, to, big.NewInt(value), params.TxGas, new(big.Int), nil)
+	return signTx(t, s, key, tx)
+}
+
+func beginBlock(s *State, height uint64) {
+	hash := crypto.Keccak256(new(big.Int).SetUint64(height).Bytes())
+	s.BeginBlock(hash, &tmspTypes.Header{Height: height, Time: 1000 + height})
+}
+
+// appendBlock runs a whole block and returns its app hash
+func appendBlock(t *testing.T, s *State, height uint64, txs ...*ethTypes.Transaction) []byte {
+	beginBlock(s, height)
+	for _, tx := range txs {
+		if res := s.AppendTx(encodeTx(t, tx)); res.IsErr() {
+			t.Fatalf("AppendTx %x: %v", tx.Hash(), res)
+		}
+	}
+	s.EndBlock(height)
+	res := s.Commit()
+	if res.IsErr() {
+		t.Fatalf("Commit %d: %v", height, res)
+	}
+	return res.Data
+}
+
+// failingDB hands out batches that fail, once armed, either on a given Put
+// or when written. A failed batch writes nothing, as LevelDB does.
+type failingDB struct {
+	*ethdb.MemDatabase
+	armed     bool
+	failAfter int //puts accepted before failing, -1 to fail on Write only
+}
+
+func (db *failingDB) NewBatch() ethdb.Batch {
+	if !db.armed {
+		return db.MemDatabase.NewBatch()
+	}
+	return &failingBatch{failAfter: db.failAfter}
+}
+
+type failingBatch struct {
+	puts      int
+	failAfter int
+}
+
+func (b *failingBatch) Put(key, value []byte) error {
+	if b.failAfter >= 0 && b.puts >= b.failAfter {
+		return errors.New("injected put failure")
+	}
+	b.puts++
+	return nil
+}
+
+func (b *failingBatch) Write() error {
+	return errors.New("injected write failure")
+}
+
+func TestCommitFailureLeavesNoPartialData(t *testing.T) {
+	for _, failAfter := range []int{-1, 0, 1, 5, 20} {
+		db := &failingDB{MemDatabase: newTestDB(t)}
+		key, from := newTestKey(t)
+		_, to := newTestKey(t)
+		s := newTestState(t, db, fund(from))
+
+		tx := transfer(t, s, key, 0, to, 1000)
+		beginBlock(s, 1)
+		if res := s.AppendTx(encodeTx(t, tx)); res.IsErr() {
+			t.Fatalf("AppendTx: %v", res)
+		}
+		s.EndBlock(1)
+
+		keys := len(db.Keys())
+		lastCommit, err := db.Get(lastCommitKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := s.Info()
+		commit := s.lastCommit
+
+		db.armed, db.failAfter = true, failAfter
+		if res := s.Commit(); res.IsOK() {
+			t.Fatalf("failAfter %d: Commit succeeded", failAfter)
+		}
+
+		if n := len(db.Keys()); n != keys {
+			t.Errorf("failAfter %d: %d keys written", failAfter, n-keys)
+		}
+		for _, k := range [][]byte{
+			tx.Hash().Bytes(),
+			txLookupKey(tx.Hash()),
+			append(receiptsPrefix, tx.Hash().Bytes()...),
+			append(statusPrefix, tx.Hash().Bytes()...),
+			blockHashKey(1),
+		} {
+			if _, err := db.Get(k); err == nil {
+				t.Errorf("failAfter %d: key %x written", failAfter, k)
+			}
+		}
+		if data, _ := db.Get(lastCommitKey); !bytes.Equal(data, lastCommit) {
+			t.Errorf("failAfter %d: LastCommit changed", failAfter)
+		}
+		if s.Info() != info {
+			t.Errorf("failAfter %d: Info changed to %s", failAfter, s.Info())
+		}
+		if !reflect.DeepEqual(s.lastCommit, commit) {
+			t.Errorf("failAfter %d: last commit changed to %+v", failAfter, s.lastCommit)
+		}
+	}
+}
+
+func TestCommitWritesBlock(t *testing.T) {
+	db := newTestDB(t)
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	s := newTestState(t, db, fund(from))
+
+	tx := transfer(t, s, key, 0, to, 1000)
+	hash := appendBlock(t, s, 1, tx)
+
+	if _, err := s.GetTransaction(tx.Hash()); err != nil {
+		t.Errorf("transaction not written: %v", err)
+	}
+	if _, err := s.GetReceipt(tx.Hash()); err != nil {
+		t.Errorf("receipt not written: %v", err)
+	}
+	block, err := s.GetBlock(1)
+	if err != nil {
+		t.Fatalf("block not written: %v", err)
+	}
+	if !bytes.Equal(hash, appHash(block.StateRoot, block.TxHash, block.ReceiptHash)) {
+		t.Errorf("app hash %x doesn't match the block", hash)
+	}
+
+	// the same database reopens at the last commit
+	restored := newTestState(t, db, nil)
+	if !reflect.DeepEqual(restored.lastCommit, s.lastCommit) {
+		t.Errorf("restored commit %+v, want %+v", restored.lastCommit, s.lastCommit)
+	}
+	if balance := restored.GetBalance(to); balance.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("restored balance %v, want 1000", balance)
+	}
+}
+
+// withSignatureValues replaces the signature of a signed transaction
+func withSignatureValues(t *testing.T, s *State, tx *ethTypes.Transaction, r, sv *big.Int, recID byte) *ethTypes.Transaction {
+	sig := make([]byte, 65)
+	copy(sig[32-len(r.Bytes()):32], r.Bytes())
+	copy(sig[64-len(sv.Bytes()):64], sv.Bytes())
+	sig[64] = recID
+	signed, err := tx.WithSignature(s.Signer(), sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestCheckTxRejections(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	gas := big.NewInt(100000)
+	tx := func(nonce uint64, to *common.Address, value, gas *big.Int, data []byte) *ethTypes.Transaction {
+		if to == nil {
+			return ethTypes.NewContractCreation(nonce, value, gas, new(big.Int), data)
+		}
+		return ethTypes.NewTransaction(nonce, *to, value, gas, new(big.Int), data)
+	}
+
+	tests := []struct {
+		name  string
+		setup func(s *State)
+		tx    func(s *State) *ethTypes.Transaction
+		code  tmspTypes.CodeType
+	}{
+		{
+			name: "valid",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(1, &to, big.NewInt(1), gas, nil))
+			},
+			code: tmspTypes.CodeType_OK,
+		},
+		{
+			name:  "gas price too low",
+			setup: func(s *State) { s.minGasPrice = big.NewInt(1) },
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(1, &to, big.NewInt(1), gas, nil))
+			},
+			code: CodeType_GasPriceTooLow,
+		},
+		{
+			name: "oversized data",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(1, &to, big.NewInt(1), gas, make([]byte, maxTxSize+1)))
+			},
+			code: CodeType_OversizedData,
+		},
+		{
+			name: "wrong chain id",
+			tx: func(s *State) *ethTypes.Transaction {
+				signed, err := ethTypes.SignTx(tx(1, &to, big.NewInt(1), gas, nil), ethTypes.NewEIP155Signer(big.NewInt(2)), key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signed
+			},
+			code: tmspTypes.CodeType_Unauthorized,
+		},
+		{
+			name: "high s signature",
+			tx: func(s *State) *ethTypes.Transaction {
+				signed := signTx(t, s, key, tx(1, &to, big.NewInt(1), gas, nil))
+				v, r, sv := signed.RawSignatureValues()
+				recID := byte(new(big.Int).Sub(v, new(big.Int).Add(big.NewInt(35), new(big.Int).Mul(s.ChainID(), big.NewInt(2)))).Uint64())
+				highS := new(big.Int).Sub(crypto.S256().Params().N, sv)
+				return withSignatureValues(t, s, signed, r, highS, recID^1)
+			},
+			code: CodeType_InvalidSignature,
+		},
+		{
+			name: "bad sender",
+			tx: func(s *State) *ethTypes.Transaction {
+				return withSignatureValues(t, s, tx(1, &to, big.NewInt(1), gas, nil), new(big.Int), new(big.Int), 0)
+			},
+			code: CodeType_InvalidSignature,
+		},
+		{
+			name: "bad nonce",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(0, &to, big.NewInt(1), gas, nil))
+			},
+			code: tmspTypes.CodeType_BadNonce,
+		},
+		{
+			name: "future nonce",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(2, &to, big.NewInt(1), gas, nil))
+			},
+			code: tmspTypes.CodeType_BadNonce,
+		},
+		{
+			name: "over block gas limit",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(1, &to, big.NewInt(1), new(big.Int).Add(s.was.gasLimit, common.Big1), nil))
+			},
+			code: CodeType_GasLimit,
+		},
+		{
+			name: "insufficient funds",
+			tx: func(s *State) *ethTypes.Transaction {
+				value, _ := new(big.Int).SetString(testBalance, 10)
+				return signTx(t, s, key, tx(1, &to, value.Add(value, common.Big1), gas, nil))
+			},
+			code: tmspTypes.CodeType_InsufficientFunds,
+		},
+		{
+			name: "invalid staking data",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(1, &StakingAddress, big.NewInt(1), gas, []byte{stakingBond}))
+			},
+			code: CodeType_InvalidStakingTx,
+		},
+		{
+			name: "intrinsic gas of a transfer",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(1, &to, big.NewInt(1), new(big.Int).Sub(params.TxGas, common.Big1), nil))
+			},
+			code: CodeType_IntrinsicGas,
+		},
+		{
+			name: "intrinsic gas of a contract creation",
+			tx: func(s *State) *ethTypes.Transaction {
+				return signTx(t, s, key, tx(1, nil, new(big.Int), params.TxGas, []byte{0x60, 0x00}))
+			},
+			code: CodeType_IntrinsicGas,
+		},
+	}
+	for _, tt := range tests {
+		s := newTestState(t, newTestDB(t), fund(from))
+		s.checkState.SetNonce(from, 1)
+		if tt.setup != nil {
+			tt.setup(s)
+		}
+		res := s.CheckTx(encodeTx(t, tt.tx(s)))
+		if res.Code != tt.code {
+			t.Errorf("%s: got code %v (%s), want %v", tt.name, res.Code, res.Log, tt.code)
+		}
+	}
+}
+
+func TestCheckTxPendingNonces(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	s := newTestState(t, newTestDB(t), fund(from))
+
+	for _, step := range []struct {
+		nonce uint64
+		code  tmspTypes.CodeType
+	}{
+		{0, tmspTypes.CodeType_OK},
+		{1, tmspTypes.CodeType_OK},
+		{3, tmspTypes.CodeType_BadNonce}, //doesn't move the pending nonce
+		{1, tmspTypes.CodeType_BadNonce},
+		{2, tmspTypes.CodeType_OK},
+	} {
+		res := s.CheckTx(encodeTx(t, transfer(t, s, key, step.nonce, to, 1)))
+		if res.Code != step.code {
+			t.Errorf("nonce %d: got code %v (%s), want %v", step.nonce, res.Code, res.Log, step.code)
+		}
+	}
+	if nonce := s.GetPendingNonce(from); nonce != 3 {
+		t.Errorf("pending nonce %d, want 3", nonce)
+	}
+	if nonce := s.GetNonce(from); nonce != 0 {
+		t.Errorf("committed nonce %d, want 0", nonce)
+	}
+
+	// the mempool view starts over from the committed state
+	appendBlock(t, s, 1, transfer(t, s, key, 0, to, 1))
+	if nonce := s.GetPendingNonce(from); nonce != 1 {
+		t.Errorf("pending nonce after commit %d, want 1", nonce)
+	}
+}
+
+func TestAppendTxRevertedExecution(t *testing.T) {
+	key, from := newTestKey(t)
+	thrower := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	stopper := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	alloc := fund(from)
+	deploy(alloc, thrower, "600056") //PUSH1 0 JUMP, an invalid jump
+	deploy(alloc, stopper, "00")     //STOP
+	s := newTestState(t, newTestDB(t), alloc)
+
+	gas, gasPrice := big.NewInt(100000), big.NewInt(2)
+	throwing := signTx(t, s, key, ethTypes.NewTransaction(0, thrower, big.NewInt(1000), gas, gasPrice, nil))
+	stopping := signTx(t, s, key, ethTypes.NewTransaction(1, stopper, big.NewInt(1000), gas, gasPrice, nil))
+
+	beginBlock(s, 1)
+	res := s.AppendTx(encodeTx(t, throwing))
+	if !res.IsOK() || res.Log == "" {
+		t.Errorf("AppendTx of a throwing call: %v", res)
+	}
+	if res := s.AppendTx(encodeTx(t, stopping)); !res.IsOK() || res.Log != "" {
+		t.Errorf("AppendTx of a successful call: %v", res)
+	}
+	s.EndBlock(1)
+	if res := s.Commit(); res.IsErr() {
+		t.Fatalf("Commit: %v", res)
+	}
+
+	if status, err := s.GetReceiptStatus(throwing.Hash()); err != nil || status != ReceiptStatusFailed {
+		t.Errorf("status of the throwing call %d (%v), want %d", status, err, ReceiptStatusFailed)
+	}
+	if status, err := s.GetReceiptStatus(stopping.Hash()); err != nil || status != ReceiptStatusSuccessful {
+		t.Errorf("status of the successful call %d (%v), want %d", status, err, ReceiptStatusSuccessful)
+	}
+	receipt, err := s.GetReceipt(throwing.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an execution error consumes all the gas
+	if receipt.GasUsed.Cmp(gas) != 0 {
+		t.Errorf("gas used %v, want %v", receipt.GasUsed, gas)
+	}
+	if nonce := s.GetNonce(from); nonce != 2 {
+		t.Errorf("nonce %d, want 2", nonce)
+	}
+	// the value of the throwing call stays with the sender
+	if balance := s.GetBalance(thrower); balance.Sign() != 0 {
+		t.Errorf("balance of the throwing contract %v, want 0", balance)
+	}
+	stopReceipt, err := s.GetReceipt(stopping.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fees := new(big.Int).Mul(new(big.Int).Add(receipt.GasUsed, stopReceipt.GasUsed), gasPrice)
+	want, _ := new(big.Int).SetString(testBalance, 10)
+	want.Sub(want, fees).Sub(want, big.NewInt(1000))
+	if balance := s.GetBalance(from); balance.Cmp(want) != 0 {
+		t.Errorf("sender balance %v, want %v", balance, want)
+	}
+}
+
+func TestReceiptPostStateRoots(t *testing.T) {
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	s := newTestState(t, newTestDB(t), fund(from))
+
+	// the expected roots are computed by applying the transfers by hand
+	expected := s.statedb.Copy()
+	var txs []*ethTypes.Transaction
+	var roots []common.Hash
+	for nonce := uint64(0); nonce < 4; nonce++ {
+		value := big.NewInt(int64(1000 * (nonce + 1)))
+		txs = append(txs, transfer(t, s, key, nonce, to, value.Int64()))
+		expected.SubBalance(from, value)
+		expected.AddBalance(to, value)
+		expected.SetNonce(from, nonce+1)
+		roots = append(roots, expected.IntermediateRoot(true))
+	}
+	appendBlock(t, s, 1, txs...)
+
+	seen := make(map[common.Hash]bool)
+	for i, tx := range txs {
+		receipt, err := s.GetReceipt(tx.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := common.BytesToHash(receipt.PostState)
+		if root != roots[i] {
+			t.Errorf("tx %d: post state %x, want %x", i, root, roots[i])
+		}
+		if seen[root] {
+			t.Errorf("tx %d: post state %x repeated", i, root)
+		}
+		seen[root] = true
+	}
+
+	block, err := s.GetBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.StateRoot != roots[len(roots)-1] {
+		t.Errorf("block root %x, want the root of the last receipt %x", block.StateRoot, roots[len(roots)-1])
+	}
+}
@@ -17,6 +17,25 @@ type JsonAccount struct {
 	Balance *big.Int
 }
 
+// JsonAccountDetail describes any account of the state. Storage holds the
+// requested slots, keyed by slot.
+type JsonAccountDetail struct {
+	Address  string
+	Balance  *big.Int
+	Nonce    uint64
+	CodeHash string
+	Code     string
+	Storage  map[string]string `json:",omitempty"`
+}
+
+// JsonTxResult answers a broadcast transaction. In commit mode the status of
+// the included transaction is given, with the reason of a failure.
+type JsonTxResult struct {
+	TxHash string
+	Status *rpc.HexNumber `json:",omitempty"`
+	Error  string         `json:",omitempty"`
+}
+
 type JsonAccountList struct {
 	Accounts []JsonAccount
 }
@@ -31,3 +50,27 @@ type SendTxArgs struct {
 	Data     string          `json:"data"`
 	Nonce    *rpc.HexNumber  `json:"nonce"`
 }
+
+// CallArgs represents the arguments of a message executed without being
+// committed.
+type CallArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      *rpc.HexNumber  `json:"gas"`
+	GasPrice *rpc.HexNumber  `json:"gasPrice"`
+	Value    *rpc.HexNumber  `json:"value"`
+	Data     string          `json:"data"`
+}
+
+// SendRawTxArgs represents a transaction signed by the client, RLP encoded.
+type SendRawTxArgs struct {
+	Data string `json:"data"`
+}
+
+// FilterArgs represents the arguments to query the logs of committed blocks.
+type FilterArgs struct {
+	FromBlock *rpc.HexNumber   `json:"fromBlock"`
+	ToBlock   *rpc.HexNumber   `json:"toBlock"`
+	Addresses []common.Address `json:"address"`
+	Topics    [][]common.Hash  `json:"topics"`
+}